@@ -0,0 +1,381 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// defaultApprovalsListen is the socket serving the approval API.
+const defaultApprovalsListen = "unix:///run/opa-docker-authz/approvals.sock"
+
+// pendingApprovalTTL is how long requests wait for approval before they are
+// forgotten.
+const pendingApprovalTTL = 24 * time.Hour
+
+// Statuses of approval requests.
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+)
+
+// approvalRequest is a denied request awaiting approval, identified by a
+// fingerprint of the principal and the request.
+type approvalRequest struct {
+	ID         string    `json:"id"`
+	Status     string    `json:"status"`
+	Principal  string    `json:"principal"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	BodySHA256 string    `json:"body_sha256,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Requested  time.Time `json:"requested"`
+	Approver   string    `json:"approver,omitempty"`
+	Decided    time.Time `json:"decided,omitempty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// approvalQueue holds the requests denied by the policy until approved,
+// persisting them to a JSON file. Approved requests are allowed when they
+// are made again by the same principal until the approval expires. A nil
+// *approvalQueue records nothing.
+type approvalQueue struct {
+	mtx      sync.Mutex
+	file     string
+	ttl      time.Duration
+	requests map[string]*approvalRequest
+	now      func() time.Time
+}
+
+// loadApprovalQueue loads the queue persisted in file, which is created on
+// the first denied request if it does not exist. Approvals are valid for ttl.
+func loadApprovalQueue(file string, ttl time.Duration) (*approvalQueue, error) {
+
+	q := &approvalQueue{file: file, ttl: ttl, requests: map[string]*approvalRequest{}, now: time.Now}
+
+	bs, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var requests []*approvalRequest
+	if err := json.Unmarshal(bs, &requests); err != nil {
+		return nil, fmt.Errorf("invalid approvals file %s: %w", file, err)
+	}
+	for _, req := range requests {
+		q.requests[req.ID] = req
+	}
+
+	return q, nil
+}
+
+// approvalID returns the ID of a request made by the principal, which is the
+// same for identical requests.
+func approvalID(principal string, r authorization.Request) string {
+
+	h := sha256.New()
+	for _, s := range []string{principal, r.RequestMethod, r.RequestURI} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	h.Write(r.RequestBody)
+
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// check returns the queued request identical to a request of the principal,
+// queueing the request for approval if there is none.
+func (q *approvalQueue) check(principal string, r authorization.Request, reason string) (approvalRequest, error) {
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := q.now()
+	q.expire(now)
+
+	id := approvalID(principal, r)
+	if req, ok := q.requests[id]; ok {
+		return *req, nil
+	}
+
+	req := &approvalRequest{
+		ID:        id,
+		Status:    approvalPending,
+		Principal: principal,
+		Method:    r.RequestMethod,
+		URI:       r.RequestURI,
+		Reason:    reason,
+		Requested: now,
+		Expires:   now.Add(pendingApprovalTTL),
+	}
+	if len(r.RequestBody) > 0 {
+		sum := sha256.Sum256(r.RequestBody)
+		req.BodySHA256 = hex.EncodeToString(sum[:])
+	}
+	q.requests[id] = req
+
+	return *req, q.save()
+}
+
+// errSelfApproval is returned when principals decide their own requests.
+var errSelfApproval = errors.New("requests cannot be decided by their own principal")
+
+// decide approves or rejects a pending request.
+func (q *approvalQueue) decide(id, approver string, approve bool) (*approvalRequest, error) {
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := q.now()
+	q.expire(now)
+
+	req, ok := q.requests[id]
+	if !ok {
+		return nil, fmt.Errorf("no pending request %s", id)
+	}
+	if req.Status != approvalPending {
+		return nil, fmt.Errorf("request %s was already %s", id, req.Status)
+	}
+	if approver == req.Principal {
+		return nil, errSelfApproval
+	}
+
+	req.Status = approvalRejected
+	if approve {
+		req.Status = approvalApproved
+		req.Expires = now.Add(q.ttl)
+	}
+	req.Approver = approver
+	req.Decided = now
+
+	copied := *req
+	return &copied, q.save()
+}
+
+// list returns the queued requests, oldest first.
+func (q *approvalQueue) list() []approvalRequest {
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.expire(q.now())
+
+	requests := make([]approvalRequest, 0, len(q.requests))
+	for _, req := range q.requests {
+		requests = append(requests, *req)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Requested.Before(requests[j].Requested) })
+
+	return requests
+}
+
+// expire forgets expired requests. The caller must hold the lock.
+func (q *approvalQueue) expire(now time.Time) {
+	for id, req := range q.requests {
+		if !now.Before(req.Expires) {
+			delete(q.requests, id)
+		}
+	}
+}
+
+// save persists the queue. The caller must hold the lock.
+func (q *approvalQueue) save() error {
+
+	requests := make([]*approvalRequest, 0, len(q.requests))
+	for _, req := range q.requests {
+		requests = append(requests, req)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Requested.Before(requests[j].Requested) })
+
+	bs, err := json.MarshalIndent(requests, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(q.file, bs)
+}
+
+// approvalConfig configures the socket serving the approval API.
+type approvalConfig struct {
+	// addr is the unix:///path of the socket, created with mode 0660.
+	addr string
+
+	// group optionally names the group owning the socket, whose members may
+	// list and decide requests.
+	group string
+}
+
+// serve serves the approval API until its listener fails. Approvers are
+// identified by the credentials of the process connecting to the socket.
+func (c approvalConfig) serve(q *approvalQueue) error {
+
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "unix" {
+		return fmt.Errorf("invalid approvals address %q, expected unix:///path", c.addr)
+	}
+
+	l, err := listenUnix(u.Path)
+	if err != nil {
+		return err
+	}
+
+	if c.group != "" {
+		g, err := user.LookupGroup(c.group)
+		if err != nil {
+			_ = l.Close()
+			return err
+		}
+		gid, err := strconv.Atoi(g.Gid)
+		if err != nil {
+			_ = l.Close()
+			return err
+		}
+		if err := os.Chown(u.Path, -1, gid); err != nil {
+			_ = l.Close()
+			return err
+		}
+	}
+
+	mux := http.NewServeMux()
+	registerApprovalHandlers(mux, q)
+
+	server := &http.Server{
+		Handler: mux,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			peer, err := peerCredentials(conn)
+			if err != nil {
+				log.Printf("Failed reading peer credentials of approver: %v", err)
+				return ctx
+			}
+			return withPeer(ctx, peer)
+		},
+	}
+
+	log.Printf("Serving the approval API on %s.", c.addr)
+	return server.Serve(l)
+}
+
+// registerApprovalHandlers adds the approval API to mux: GET /approvals lists
+// the queue, and POST /approvals/{id}/approve and POST /approvals/{id}/reject
+// decide a pending request. The approver is the user of the process
+// connected to the socket, which may not decide its own requests.
+func registerApprovalHandlers(mux *http.ServeMux, q *approvalQueue) {
+
+	mux.HandleFunc("GET /approvals", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, q.list())
+	})
+
+	decide := func(approve bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			approver, ok := resolvePeer(r.Context())
+			if !ok {
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "unidentified approver"})
+				return
+			}
+			req, err := q.decide(r.PathValue("id"), approver.Name, approve)
+			if errors.Is(err, errSelfApproval) {
+				writeJSON(w, http.StatusForbidden, map[string]string{"message": err.Error()})
+				return
+			} else if err != nil {
+				writeJSON(w, http.StatusConflict, map[string]string{"message": err.Error()})
+				return
+			}
+			log.Printf("Request %s of %s (%s %s) was %s by %s", req.ID, req.Principal, req.Method, req.URI, req.Status, req.Approver)
+			writeJSON(w, http.StatusOK, req)
+		}
+	}
+	mux.HandleFunc("POST /approvals/{id}/approve", decide(true))
+	mux.HandleFunc("POST /approvals/{id}/reject", decide(false))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// approveCommand implements the approve subcommand, which approves, rejects
+// or lists requests through the approval socket of a running plugin, as the
+// current user.
+func approveCommand(args []string) int {
+
+	fs := flag.NewFlagSet("approve", flag.ContinueOnError)
+	addr := fs.String("approvals-listen", defaultApprovalsListen, "sets the unix:///path of the socket serving the approval API of the plugin")
+	reject := fs.Bool("reject", false, "rejects the request instead of approving it")
+	list := fs.Bool("list", false, "lists the queued requests")
+	fs.Usage = func() {
+		_, _ = fmt.Fprintln(fs.Output(), "Usage: opa-docker-authz approve [flags] <request-id>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	u, err := url.Parse(*addr)
+	if err != nil || u.Scheme != "unix" {
+		_, _ = fmt.Fprintf(os.Stderr, "invalid approvals address %q, expected unix:///path\n", *addr)
+		return 2
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", u.Path)
+		},
+	}}
+
+	const base = "http://approvals/approvals"
+
+	var resp *http.Response
+	switch {
+	case *list:
+		resp, err = client.Get(base)
+	case fs.NArg() == 1:
+		action := "approve"
+		if *reject {
+			action = "reject"
+		}
+		resp, err = client.Post(base+"/"+url.PathEscape(fs.Arg(0))+"/"+action, "", nil)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestApproveCommand(t *testing.T) {
+	dir := t.TempDir()
+	q, err := loadApprovalQueue(filepath.Join(dir, "approvals.json"), time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	r := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}
+	req, _ := q.check("alice", r, "")
+	own, _ := q.check(currentUser(t), r, "")
+
+	socket := filepath.Join(dir, "approvals.sock")
+	addr := "unix://" + socket
+	go func() { _ = approvalConfig{addr: addr}.serve(q) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(socket); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code := approveCommand([]string{"-approvals-listen", addr, "-list"}); code != 0 {
+		t.Errorf("Expected requests to be listed, got exit code %d", code)
+	}
+	if code := approveCommand([]string{"-approvals-listen", addr, own.ID}); code != 1 {
+		t.Errorf("Expected own request not to be approved, got exit code %d", code)
+	}
+	if code := approveCommand([]string{"-approvals-listen", addr, "-reject", req.ID}); code != 0 {
+		t.Errorf("Expected request to be rejected, got exit code %d", code)
+	}
+
+	for _, got := range q.list() {
+		switch got.ID {
+		case req.ID:
+			if got.Status != approvalRejected || got.Approver != currentUser(t) {
+				t.Errorf("Expected request rejected by the current user, got %+v", got)
+			}
+		case own.ID:
+			if got.Status != approvalPending {
+				t.Errorf("Expected own request to remain pending, got %+v", got)
+			}
+		}
+	}
+}
+
+// currentUser returns the name the peercred identity source resolves for the
+// current process.
+func currentUser(t *testing.T) string {
+	identity, _ := resolvePeer(withPeer(t.Context(), &PeerCredentials{UID: os.Getuid(), GID: os.Getgid()}))
+	return identity.Name
+}
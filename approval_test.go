@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestApprovalQueue(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "approvals.json")
+	q, err := loadApprovalQueue(file, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	now := time.Date(2024, 6, 7, 10, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	r := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create", RequestBody: []byte(`{"HostConfig": {"Privileged": true}}`)}
+
+	req, err := q.check("alice", r, "privileged")
+	if err != nil || req.Status != approvalPending || req.Principal != "alice" || req.BodySHA256 == "" {
+		t.Fatalf("Expected pending request, got %+v (%v)", req, err)
+	}
+	if again, _ := q.check("alice", r, "privileged"); again.ID != req.ID {
+		t.Errorf("Expected identical request to have the same ID, got %s and %s", req.ID, again.ID)
+	}
+	if other, _ := q.check("bob", r, "privileged"); other.ID == req.ID {
+		t.Errorf("Expected request of another principal to have another ID")
+	}
+
+	if _, err := q.decide("unknown", "carol", true); err == nil {
+		t.Errorf("Expected error approving unknown request")
+	}
+	approved, err := q.decide(req.ID, "carol", true)
+	if err != nil || approved.Status != approvalApproved || approved.Approver != "carol" {
+		t.Fatalf("Expected approved request, got %+v (%v)", approved, err)
+	}
+	if _, err := q.decide(req.ID, "carol", true); err == nil {
+		t.Errorf("Expected error approving request twice")
+	}
+	bobs, _ := q.check("bob", r, "privileged")
+	if _, err := q.decide(bobs.ID, "bob", true); !errors.Is(err, errSelfApproval) {
+		t.Errorf("Expected error approving own request, got %v", err)
+	}
+
+	reloaded, err := loadApprovalQueue(file, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	reloaded.now = q.now
+	if got, _ := reloaded.check("alice", r, "privileged"); got.Status != approvalApproved {
+		t.Errorf("Expected persisted approval, got %+v", got)
+	}
+
+	now = now.Add(time.Hour)
+	if got, _ := q.check("alice", r, "privileged"); got.Status != approvalPending {
+		t.Errorf("Expected expired approval to be requested again, got %+v", got)
+	}
+	if requests := q.list(); len(requests) != 2 {
+		t.Errorf("Expected 2 queued requests, got %+v", requests)
+	}
+}
+
+func TestApprovalHandlers(t *testing.T) {
+	q, err := loadApprovalQueue(filepath.Join(t.TempDir(), "approvals.json"), time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	peer := &PeerCredentials{UID: os.Getuid(), GID: os.Getgid()}
+	approver, _ := resolvePeer(withPeer(context.Background(), peer))
+
+	req, _ := q.check("alice", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}, "")
+	own, _ := q.check(approver.Name, authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}, "")
+
+	mux := http.NewServeMux()
+	registerApprovalHandlers(mux, q)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/approvals", nil))
+	var requests []approvalRequest
+	if err := json.NewDecoder(w.Body).Decode(&requests); err != nil || len(requests) != 2 {
+		t.Errorf("Expected queued requests, got %+v (%v)", requests, err)
+	}
+
+	tests := []struct {
+		path   string
+		peer   *PeerCredentials
+		status int
+	}{
+		{"/approvals/" + req.ID + "/approve", nil, http.StatusUnauthorized},
+		{"/approvals/" + req.ID + "/approve?approver=carol", nil, http.StatusUnauthorized},
+		{"/approvals/" + own.ID + "/approve", peer, http.StatusForbidden},
+		{"/approvals/" + req.ID + "/approve", peer, http.StatusOK},
+		{"/approvals/" + req.ID + "/reject", peer, http.StatusConflict},
+		{"/approvals/unknown/approve", peer, http.StatusConflict},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("POST", tc.path, nil)
+		if tc.peer != nil {
+			r = r.WithContext(withPeer(r.Context(), tc.peer))
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("Expected status %d for %s (peer %v), got %d", tc.status, tc.path, tc.peer, w.Code)
+		}
+	}
+
+	for _, got := range q.list() {
+		if got.ID == req.ID && got.Approver != approver.Name {
+			t.Errorf("Expected request approved by %q, got %+v", approver.Name, got)
+		}
+	}
+}
+
+func TestAuthZReqApproval(t *testing.T) {
+	q, err := loadApprovalQueue(filepath.Join(t.TempDir(), "approvals.json"), time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/approval.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		approvals:  q,
+	}
+	request := func(user string) authorization.Request {
+		return authorization.Request{
+			RequestMethod:   "POST",
+			RequestURI:      "/v1.47/containers/create",
+			RequestHeaders:  map[string]string{"Content-Type": "application/json"},
+			RequestBody:     []byte(`{"Image": "busybox", "HostConfig": {"Privileged": true}}`),
+			User:            user,
+			UserAuthNMethod: "TLS",
+		}
+	}
+
+	res := plugin.AuthZReq(request("alice"))
+	if res.Allow || !strings.Contains(res.Msg, "privileged containers require approval") || !strings.Contains(res.Msg, "pending approval") {
+		t.Fatalf("Expected request to be queued for approval, got %+v", res)
+	}
+
+	requests := q.list()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one queued request, got %+v", requests)
+	}
+	if _, err := q.decide(requests[0].ID, "carol", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := plugin.AuthZReq(request("alice")); !res.Allow {
+		t.Errorf("Expected approved request to be allowed, got %+v", res)
+	}
+	if res := plugin.AuthZReq(request("bob")); res.Allow {
+		t.Errorf("Expected request of another principal to be denied, got %+v", res)
+	}
+
+	unverified := request("")
+	unverified.UserAuthNMethod = ""
+	unverified.RequestHeaders["Authz-User"] = "alice"
+	if res := plugin.AuthZReq(unverified); res.Allow || strings.Contains(res.Msg, "(request ") {
+		t.Errorf("Expected request of an unverified principal to be denied without approval, got %+v", res)
+	}
+	if requests := q.list(); len(requests) != 2 {
+		t.Errorf("Expected request of an unverified principal not to be queued, got %+v", requests)
+	}
+}
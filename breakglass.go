@@ -0,0 +1,289 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// breakGlassAudience is the audience of break-glass tokens, which keeps
+// other tokens signed by the same key from being accepted as overrides.
+const breakGlassAudience = "opa-docker-authz/break-glass"
+
+// Outcomes of requests presenting a break-glass token, used as the "result"
+// label of the break-glass metric.
+const (
+	breakGlassAllowed  = "allowed"
+	breakGlassOverride = "override"
+	breakGlassRefused  = "refused"
+)
+
+var breakGlassRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "opa_docker_authz",
+		Name:      "break_glass_requests_total",
+		Help:      "Number of requests presenting a valid break-glass token, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(breakGlassRequestsTotal)
+}
+
+// BreakGlass is the verified emergency override presented with a request,
+// exposed to policy as input.BreakGlass.
+type BreakGlass struct {
+	ID        string
+	Principal string
+	Reason    string
+	Expires   string
+	Scope     []string
+}
+
+type breakGlassContextKey struct{}
+
+// withBreakGlass returns a context carrying the override presented with the
+// request.
+func withBreakGlass(ctx context.Context, bg BreakGlass) context.Context {
+	return context.WithValue(ctx, breakGlassContextKey{}, bg)
+}
+
+// breakGlassVerifier verifies the break-glass tokens presented with
+// requests. A nil *breakGlassVerifier accepts no tokens.
+type breakGlassVerifier struct {
+	header   string
+	verifier *jwtVerifier
+}
+
+// newBreakGlassVerifier returns a verifier accepting tokens in the named
+// header, signed by the key in the PEM encoded public key file.
+func newBreakGlassVerifier(ctx context.Context, header, publicKeyFile string) (*breakGlassVerifier, error) {
+
+	bs, err := os.ReadFile(publicKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err := newJWTVerifier(ctx, string(bs), "", breakGlassAudience)
+	if err != nil {
+		return nil, err
+	}
+
+	return &breakGlassVerifier{header: header, verifier: verifier}, nil
+}
+
+// resolve returns the override presented with the request, if its token is
+// valid and was issued to anyone, or to the principal making the request.
+// Tokens issued to a principal are only accepted from a verified identity,
+// since anyone can assert a name through the header source.
+func (b *breakGlassVerifier) resolve(ctx context.Context, r authorization.Request, identity Identity) (BreakGlass, bool) {
+
+	if b == nil {
+		return BreakGlass{}, false
+	}
+
+	claims, ok := b.verifier.verify(ctx, bearerToken(requestHeader(r, b.header)))
+	if !ok {
+		return BreakGlass{}, false
+	}
+
+	bg := BreakGlass{Scope: []string{}}
+	bg.ID, _ = claims["jti"].(string)
+	bg.Principal, _ = claims["sub"].(string)
+	bg.Reason, _ = claims["reason"].(string)
+	exp, ok := claims["exp"].(json.Number)
+	if !ok || bg.ID == "" || bg.Reason == "" {
+		log.Printf("Ignoring break-glass token without ID, reason or expiry")
+		return BreakGlass{}, false
+	}
+	if bg.Principal != "" && (bg.Principal != identity.Name || !identity.Verified) {
+		log.Printf("Ignoring break-glass token %s issued to %q presented by %q (verified: %v)", bg.ID, bg.Principal, identity.Name, identity.Verified)
+		return BreakGlass{}, false
+	}
+	if expires, err := exp.Int64(); err == nil {
+		bg.Expires = time.Unix(expires, 0).UTC().Format(time.RFC3339)
+	}
+	if scope, ok := claims["scope"].([]interface{}); ok {
+		for _, s := range scope {
+			if s, ok := s.(string); ok {
+				bg.Scope = append(bg.Scope, s)
+			}
+		}
+	}
+
+	return bg, true
+}
+
+// auditBreakGlass logs a high-severity audit record of a request presenting
+// a break-glass token, returning whether the token overrides the decision.
+// Tokens override denials and failed evaluations, unless the policy refused
+// the override.
+func (p DockerAuthZPlugin) auditBreakGlass(ctx context.Context, r authorization.Request, bg BreakGlass, d decision, err error) bool {
+
+	result := breakGlassAllowed
+	switch {
+	case d.allow && err == nil:
+	case d.refuseBreakGlass && err == nil:
+		result = breakGlassRefused
+	default:
+		result = breakGlassOverride
+	}
+	breakGlassRequestsTotal.WithLabelValues(result).Inc()
+
+	record := map[string]interface{}{
+		"severity":      "critical",
+		"event":         "break_glass",
+		"result":        result,
+		"token_id":      bg.ID,
+		"issued_to":     bg.Principal,
+		"identity":      p.identity.resolve(ctx, r),
+		"reason":        bg.Reason,
+		"expires":       bg.Expires,
+		"scope":         bg.Scope,
+		"method":        r.RequestMethod,
+		"path":          r.RequestURI,
+		"mode":          p.mode,
+		"policy_result": d.allow,
+		"timestamp":     time.Now().Format(time.RFC3339Nano),
+	}
+	if err != nil {
+		record["error"] = err.Error()
+	}
+
+	bs, _ := json.Marshal(record)
+	log.Printf("BREAK-GLASS: %s", string(bs))
+
+	return result == breakGlassOverride
+}
+
+// breakGlassCommand implements the break-glass subcommand, which prints a
+// signed break-glass token.
+func breakGlassCommand(args []string) int {
+
+	fs := flag.NewFlagSet("break-glass", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "sets the path of the PEM encoded P-256 private key signing the token")
+	reason := fs.String("reason", "", "sets the reason for the override, e.g. an incident ID (required)")
+	principal := fs.String("principal", "", "sets the principal the token is issued to (empty allows anyone presenting it)")
+	ttl := fs.Duration("ttl", time.Hour, "sets how long the token is valid for")
+	scope := fs.String("scope", "", "sets a comma separated list of scopes exposed to policy, e.g. containers,exec")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *keyFile == "" || *reason == "" || *ttl <= 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "break-glass requires -key-file, -reason and a positive -ttl")
+		return 2
+	}
+
+	key, err := loadECPrivateKey(*keyFile)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	var scopes []string
+	if *scope != "" {
+		scopes = strings.Split(*scope, ",")
+	}
+
+	token, bg, err := issueBreakGlass(key, *principal, *reason, *ttl, scopes)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "Break-glass token %s valid until %s\n", bg.ID, bg.Expires)
+	fmt.Println(token)
+
+	return 0
+}
+
+// issueBreakGlass signs a break-glass token valid for ttl, returning the
+// token and the override it grants.
+func issueBreakGlass(key *ecdsa.PrivateKey, principal, reason string, ttl time.Duration, scope []string) (string, BreakGlass, error) {
+
+	id, err := uuid4()
+	if err != nil {
+		return "", BreakGlass{}, err
+	}
+
+	now := time.Now()
+	expires := now.Add(ttl)
+	claims := map[string]interface{}{
+		"jti":    id,
+		"aud":    breakGlassAudience,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    expires.Unix(),
+		"reason": reason,
+	}
+	if principal != "" {
+		claims["sub"] = principal
+	}
+	if len(scope) > 0 {
+		claims["scope"] = scope
+	}
+
+	token, err := signES256(key, "", claims)
+	if err != nil {
+		return "", BreakGlass{}, err
+	}
+
+	bg := BreakGlass{
+		ID:        id,
+		Principal: principal,
+		Reason:    reason,
+		Expires:   time.Unix(expires.Unix(), 0).UTC().Format(time.RFC3339),
+		Scope:     append([]string{}, scope...),
+	}
+
+	return token, bg, nil
+}
+
+// loadECPrivateKey loads a PEM encoded SEC 1 or PKCS #8 EC private key.
+func loadECPrivateKey(file string) (*ecdsa.PrivateKey, error) {
+
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, bs = pem.Decode(bs)
+		if block == nil {
+			return nil, fmt.Errorf("no EC private key found in %s", file)
+		}
+
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ecKey, ok := key.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("private key in %s is not an EC key", file)
+			}
+			return ecKey, nil
+		}
+	}
+}
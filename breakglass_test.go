@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestBreakGlass(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "break-glass.pem")
+	writePEM(t, keyFile, "PRIVATE KEY", der)
+	der, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKeyFile := filepath.Join(dir, "break-glass.pub.pem")
+	writePEM(t, publicKeyFile, "PUBLIC KEY", der)
+
+	loaded, err := loadECPrivateKey(keyFile)
+	if err != nil || !loaded.Equal(key) {
+		t.Fatalf("Expected private key to load, got %v", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := newBreakGlassVerifier(context.Background(), "X-Break-Glass", publicKeyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/breakglass.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		breakGlass: verifier,
+	}
+
+	issue := func(key *ecdsa.PrivateKey, principal string, ttl time.Duration) string {
+		token, _, err := issueBreakGlass(key, principal, "INC-1234", ttl, []string{"containers"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := issue(key, "alice", time.Hour)
+
+	tests := []struct {
+		name     string
+		uri      string
+		token    string
+		allowed  bool
+		override float64
+	}{
+		{"no token", "/v1.47/containers/create", "", false, 0},
+		{"valid token", "/v1.47/containers/create", valid, true, 1},
+		{"valid bearer token", "/v1.47/containers/create", "Bearer " + valid, true, 1},
+		{"token of another principal", "/v1.47/containers/create", issue(key, "bob", time.Hour), false, 0},
+		{"token presented by an unverified principal", "/v1.47/containers/create", valid, false, 0},
+		{"token for anyone", "/v1.47/containers/create", issue(key, "", time.Hour), true, 1},
+		{"expired token", "/v1.47/containers/create", issue(key, "alice", -time.Minute), false, 0},
+		{"token signed by another key", "/v1.47/containers/create", issue(other, "alice", time.Hour), false, 0},
+		{"override refused by policy", "/v1.47/plugins/pull", valid, false, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := authorization.Request{
+				RequestMethod:   "POST",
+				RequestURI:      tc.uri,
+				RequestHeaders:  map[string]string{"X-Break-Glass": tc.token},
+				User:            "alice",
+				UserAuthNMethod: "TLS",
+			}
+			if strings.Contains(tc.name, "unverified") {
+				r.User, r.UserAuthNMethod = "", ""
+				r.RequestHeaders["Authz-User"] = "alice"
+			}
+
+			overrides := counterValue(t, breakGlassRequestsTotal.WithLabelValues(breakGlassOverride))
+			if res := plugin.AuthZReq(r); res.Allow != tc.allowed {
+				t.Errorf("Expected allowed: %v, got %+v", tc.allowed, res)
+			}
+			if got := counterValue(t, breakGlassRequestsTotal.WithLabelValues(breakGlassOverride)) - overrides; got != tc.override {
+				t.Errorf("Expected %v overrides, got %v", tc.override, got)
+			}
+		})
+	}
+
+	t.Run("input", func(t *testing.T) {
+		r := authorization.Request{
+			RequestMethod:  "POST",
+			RequestURI:     "/v1.47/containers/create",
+			RequestHeaders: map[string]string{"X-Break-Glass": valid},
+			User:           "alice",
+		}
+		bg, ok := verifier.resolve(context.Background(), r, Identity{Name: "alice", Verified: true})
+		if !ok {
+			t.Fatalf("Expected valid token")
+		}
+		input, err := plugin.buildInput(withBreakGlass(context.Background(), bg), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := input["BreakGlass"].(BreakGlass)
+		if got.ID == "" || got.Principal != "alice" || got.Reason != "INC-1234" || got.Expires == "" || !reflect.DeepEqual(got.Scope, []string{"containers"}) {
+			t.Errorf("Unexpected input.BreakGlass %+v", got)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+// The Docker-aware built-in functions are registered globally, so they are
+// available to policies in every mode, including through the OPA SDK.
+func init() {
+
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:        "docker.image.parse",
+		Description: "Parses an image reference the way the Docker daemon does, returning its registry, repository, tag and digest.",
+		Decl:        types.NewFunction(types.Args(types.Named("ref", types.S)), types.Named("image", types.NewObject(nil, types.NewDynamicProperty(types.S, types.A)))),
+		Memoize:     true,
+	}, func(_ rego.BuiltinContext, ref *ast.Term) (*ast.Term, error) {
+		s, err := builtinString(ref)
+		if err != nil {
+			return nil, err
+		}
+		image, err := parseImageRef(s)
+		if err != nil {
+			return nil, err
+		}
+		return termOf(image)
+	})
+
+	rego.RegisterBuiltin2(&rego.Function{
+		Name:             "docker.path.under",
+		Description:      "Reports whether a host path, resolved through symlinks and .. segments, is a prefix path or below it.",
+		Decl:             types.NewFunction(types.Args(types.Named("path", types.S), types.Named("prefix", types.S)), types.Named("under", types.B)),
+		Memoize:          true,
+		Nondeterministic: true,
+	}, func(_ rego.BuiltinContext, path, prefix *ast.Term) (*ast.Term, error) {
+		p, err := builtinString(path)
+		if err != nil {
+			return nil, err
+		}
+		pre, err := builtinString(prefix)
+		if err != nil {
+			return nil, err
+		}
+		return ast.BooleanTerm(pathUnder(p, pre)), nil
+	})
+
+	rego.RegisterBuiltin1(&rego.Function{
+		Name:        "docker.api.route",
+		Description: "Splits the path of a Docker API request into the collection, object type, object reference and action it refers to.",
+		Decl:        types.NewFunction(types.Args(types.Named("path", types.S)), types.Named("route", types.NewObject(nil, types.NewDynamicProperty(types.S, types.S)))),
+		Memoize:     true,
+	}, func(_ rego.BuiltinContext, path *ast.Term) (*ast.Term, error) {
+		s, err := builtinString(path)
+		if err != nil {
+			return nil, err
+		}
+		return termOf(parseRoute(s))
+	})
+}
+
+func builtinString(t *ast.Term) (string, error) {
+	s, ok := t.Value.(ast.String)
+	if !ok {
+		return "", fmt.Errorf("expected string, got %v", ast.ValueName(t.Value))
+	}
+	return string(s), nil
+}
+
+func termOf(v interface{}) (*ast.Term, error) {
+	value, err := ast.InterfaceToValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return ast.NewTerm(value), nil
+}
+
+// defaultRegistry is the registry of image references without one.
+const defaultRegistry = "docker.io"
+
+var (
+	imagePathComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	imageTag           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	imageDigest        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// imageRef is a parsed image reference. Name is the fully qualified
+// repository, and Tag defaults to latest for references without a tag or
+// digest, as when the Docker daemon pulls them.
+type imageRef struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Name       string `json:"name"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+	Official   bool   `json:"official"`
+}
+
+// parseImageRef parses an image reference like the Docker daemon, so that
+// busybox, library/busybox and docker.io/library/busybox:latest all name
+// the same image.
+func parseImageRef(ref string) (imageRef, error) {
+
+	var image imageRef
+	remainder := ref
+
+	if name, digest, ok := strings.Cut(remainder, "@"); ok {
+		if !imageDigest.MatchString(digest) {
+			return image, fmt.Errorf("invalid image reference %q: invalid digest", ref)
+		}
+		image.Digest = digest
+		remainder = name
+	}
+
+	if i := strings.LastIndex(remainder, ":"); i > strings.LastIndex(remainder, "/") {
+		image.Tag = remainder[i+1:]
+		if !imageTag.MatchString(image.Tag) {
+			return image, fmt.Errorf("invalid image reference %q: invalid tag", ref)
+		}
+		remainder = remainder[:i]
+	}
+
+	components := strings.Split(remainder, "/")
+	image.Registry = defaultRegistry
+	if first := components[0]; len(components) > 1 && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		image.Registry = first
+		components = components[1:]
+	}
+	if image.Registry == "index.docker.io" {
+		image.Registry = defaultRegistry
+	}
+	if image.Registry == defaultRegistry && len(components) == 1 {
+		components = append([]string{"library"}, components...)
+	}
+
+	for _, component := range components {
+		if !imagePathComponent.MatchString(component) {
+			return image, fmt.Errorf("invalid image reference %q: repository must be lowercase alphanumerics separated by ., _, __ or -", ref)
+		}
+	}
+
+	image.Repository = strings.Join(components, "/")
+	image.Name = image.Registry + "/" + image.Repository
+	image.Official = image.Registry == defaultRegistry && components[0] == "library"
+	if image.Tag == "" && image.Digest == "" {
+		image.Tag = "latest"
+	}
+
+	return image, nil
+}
+
+// resolveHostPath resolves an absolute host path through symlinks and ..
+// segments, component by component as the kernel does. Components that do
+// not exist are kept as they are, since the Docker daemon creates missing
+// bind mount sources.
+func resolveHostPath(path string) string {
+
+	if !filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+
+	resolved := string(os.PathSeparator)
+	for _, component := range strings.Split(filepath.ToSlash(path), "/") {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, component)
+		if target, err := filepath.EvalSymlinks(next); err == nil {
+			next = target
+		}
+		resolved = next
+	}
+
+	return resolved
+}
+
+// pathUnder reports whether the host path is prefix or below it, once both
+// are resolved. Relative paths, like the names of volumes, are never under
+// a prefix.
+func pathUnder(path, prefix string) bool {
+
+	path, prefix = resolveHostPath(path), resolveHostPath(prefix)
+	if path == prefix || prefix == string(os.PathSeparator) {
+		return filepath.IsAbs(path)
+	}
+
+	return strings.HasPrefix(path, prefix+string(os.PathSeparator))
+}
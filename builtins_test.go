@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		ref      string
+		expected imageRef
+		err      bool
+	}{
+		{ref: "busybox", expected: imageRef{Registry: "docker.io", Repository: "library/busybox", Name: "docker.io/library/busybox", Tag: "latest", Official: true}},
+		{ref: "library/busybox:1.36", expected: imageRef{Registry: "docker.io", Repository: "library/busybox", Name: "docker.io/library/busybox", Tag: "1.36", Official: true}},
+		{ref: "index.docker.io/library/busybox", expected: imageRef{Registry: "docker.io", Repository: "library/busybox", Name: "docker.io/library/busybox", Tag: "latest", Official: true}},
+		{ref: "acme/web", expected: imageRef{Registry: "docker.io", Repository: "acme/web", Name: "docker.io/acme/web", Tag: "latest"}},
+		{ref: "registry.company.com:8885/bash:latest", expected: imageRef{Registry: "registry.company.com:8885", Repository: "bash", Name: "registry.company.com:8885/bash", Tag: "latest"}},
+		{ref: "localhost/web@" + digest, expected: imageRef{Registry: "localhost", Repository: "web", Name: "localhost/web", Digest: digest}},
+		{ref: "ghcr.io/acme/web:v1@" + digest, expected: imageRef{Registry: "ghcr.io", Repository: "acme/web", Name: "ghcr.io/acme/web", Tag: "v1", Digest: digest}},
+		{ref: "Busybox", err: true},
+		{ref: "busybox:", err: true},
+		{ref: "busybox@sha256:abc", err: true},
+		{ref: "acme//web", err: true},
+		{ref: "", err: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ref, func(t *testing.T) {
+			image, err := parseImageRef(tc.ref)
+			if (err != nil) != tc.err {
+				t.Fatalf("Expected error: %v, got %v", tc.err, err)
+			}
+			if err == nil && image != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, image)
+			}
+		})
+	}
+}
+
+func TestPathUnder(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "srv"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "etc"), filepath.Join(dir, "srv", "config")); err != nil {
+		t.Fatal(err)
+	}
+	etc := filepath.Join(dir, "etc")
+
+	tests := []struct {
+		path     string
+		prefix   string
+		expected bool
+	}{
+		{etc, etc, true},
+		{etc + "/ssl", etc + "/", true},
+		{dir + "/etcetera", etc, false},
+		{dir + "/srv", etc, false},
+		{dir + "/srv/config", etc, true},
+		{dir + "/srv/config/ssl/certs", etc, true},
+		{dir + "/srv/../etc/passwd", etc, true},
+		{dir + "/srv/./config/..", etc, false},
+		{dir + "/missing/../srv/config/passwd", etc, true},
+		{dir + "/srv/config/../srv", etc, false},
+		{dir + "/srv/config/../etc", etc, true},
+		{"data", "data", false},
+		{etc, "/", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			if got := pathUnder(tc.path, tc.prefix); got != tc.expected {
+				t.Errorf("Expected %v for %v under %v, got %v", tc.expected, tc.path, tc.prefix, got)
+			}
+		})
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected interface{}
+	}{
+		{`docker.image.parse("busybox").name`, "docker.io/library/busybox"},
+		{`docker.image.parse("Busybox")`, nil},
+		{`docker.path.under("/etc/../etc/ssl", "/etc")`, true},
+		{`docker.api.route("/v1.47/containers/web/stop?t=1")`, map[string]interface{}{"Collection": "containers", "Type": "container", "Ref": "web", "Action": "stop"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.query, func(t *testing.T) {
+			rs, err := rego.New(rego.Query(tc.query)).Eval(context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			var got interface{}
+			if len(rs) > 0 {
+				got = rs[0].Expressions[0].Value
+			}
+			if expected, ok := tc.expected.(map[string]interface{}); ok {
+				route, _ := got.(map[string]interface{})
+				for k, v := range expected {
+					if route[k] != v {
+						t.Errorf("Expected %v, got %v", expected, got)
+					}
+				}
+			} else if got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAuthZReqBuiltins(t *testing.T) {
+	policy := `package docker.authz
+
+default allow := false
+
+allow if {
+	docker.api.route(input.Path).Action == "create"
+	image := docker.image.parse(input.Body.Image)
+	image.official
+	image.tag != "latest"
+}
+`
+
+	create := func(image string) authorization.Request {
+		return authorization.Request{
+			RequestMethod:  "POST",
+			RequestURI:     "/v1.47/containers/create",
+			RequestBody:    []byte(`{"Image": "` + image + `"}`),
+			RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		}
+	}
+
+	tests := []struct {
+		image         string
+		expectedAllow bool
+	}{
+		{"busybox:1.36", true},
+		{"docker.io/library/busybox:1.36", true},
+		{"busybox", false},
+		{"acme/busybox:1.36", false},
+		{"BUSYBOX:1.36", false},
+	}
+
+	for name, plugin := range paritySources(t, policy) {
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range tests {
+				res := plugin.AuthZReq(create(tc.image))
+				if res.Allow != tc.expectedAllow || res.Err != "" {
+					t.Errorf("%s: expected allow: %v, got %+v", tc.image, tc.expectedAllow, res)
+				}
+			}
+		})
+	}
+}
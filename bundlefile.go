@@ -0,0 +1,182 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/v1/bundle"
+	"github.com/open-policy-agent/opa/v1/keys"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// loadedBundle is an OPA bundle evaluated in-process.
+type loadedBundle struct {
+	name   string
+	bundle *bundle.Bundle
+
+	// hash is the SHA-256 hex digest of the bundle files, keying cached
+	// decisions.
+	hash string
+
+	// revision is the name of the bundle followed by its manifest revision,
+	// or by the revision of its files if the manifest has none.
+	revision string
+}
+
+func newLoadedBundle(name string, b *bundle.Bundle, hash string) *loadedBundle {
+
+	revision := b.Manifest.Revision
+	if revision == "" {
+		revision = policyFileRevision(hash)
+	}
+
+	return &loadedBundle{name: name, bundle: b, hash: hash, revision: name + "@" + revision}
+}
+
+// eval evaluates the allow decision at query against the bundle.
+func (lb *loadedBundle) eval(ctx context.Context, c compileOptions, query string, input interface{}) (decision, error) {
+
+	eval := rego.New(append(c.regoOptions(),
+		rego.Query(query),
+		rego.Input(input),
+		rego.ParsedBundle(lb.name, lb.bundle),
+	)...)
+
+	rs, err := eval.Eval(ctx)
+	if err != nil {
+		return decision{}, err
+	}
+
+	if len(rs) == 0 {
+		// Decision is undefined. Fallback to deny.
+		return decision{}, nil
+	}
+
+	return parseDecision(rs[0].Expressions[0].Value)
+}
+
+// policy returns the bundle as a version of the policy, evaluated under the
+// compile options.
+func (lb *loadedBundle) policy(c compileOptions) policyVersion {
+	return policyVersion{
+		hash:     lb.hash,
+		revision: lb.revision,
+		eval: func(ctx context.Context, query string, input interface{}) (decision, error) {
+			return lb.eval(ctx, c, query, input)
+		},
+	}
+}
+
+// bundleFile is a local bundle archive, like those built by `opa build`,
+// which is read again whenever it changes. If a verification key is
+// configured, only bundles signed with it are activated.
+type bundleFile struct {
+	path         string
+	name         string
+	verification *bundle.VerificationConfig
+	compile      compileOptions
+
+	mtx    sync.Mutex
+	loaded *loadedBundle
+}
+
+// newBundleFile configures a bundle archive. key is a PEM encoded public key
+// or secret, or the path of a file holding one, verifying the signatures of
+// the bundle with the algorithm alg. Signatures are not verified if key is
+// empty. Bundles whose policies do not compile under c are never activated.
+func newBundleFile(path, key, keyID, alg string, c compileOptions) (*bundleFile, error) {
+
+	bf := &bundleFile{
+		path:    path,
+		name:    strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".gz"), ".tar"),
+		compile: c,
+	}
+
+	if key != "" {
+		kc, err := keys.NewKeyConfig(key, alg, "")
+		if err != nil {
+			return nil, err
+		}
+		bf.verification = bundle.NewVerificationConfig(map[string]*bundle.KeyConfig{keyID: kc}, keyID, "", nil)
+	}
+
+	return bf, nil
+}
+
+// load returns the bundle, reading it again if the archive changed. Bundles
+// that cannot be read, verified or compiled are never activated.
+func (bf *bundleFile) load() (*loadedBundle, error) {
+
+	bs, err := os.ReadFile(bf.path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(bs)
+	hash := hex.EncodeToString(sum[:])
+
+	bf.mtx.Lock()
+	defer bf.mtx.Unlock()
+
+	if bf.loaded != nil && bf.loaded.hash == hash {
+		return bf.loaded, nil
+	}
+
+	reader := bf.compile.bundleReader(bundle.NewReader(bytes.NewReader(bs)))
+	if bf.verification != nil {
+		reader = reader.WithBundleVerificationConfig(bf.verification)
+	}
+
+	b, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	if err := bf.compile.compile(b.ParsedModules(bf.name)); err != nil {
+		return nil, err
+	}
+
+	bf.loaded = newLoadedBundle(bf.name, &b, hash)
+	return bf.loaded, nil
+}
+
+// Policy returns the bundle, refusing to activate it if it cannot be read,
+// verified or compiled.
+func (bf *bundleFile) Policy(context.Context) (policyVersion, error) {
+
+	lb, err := bf.load()
+	if err != nil {
+		log.Printf("Refusing to activate policy bundle %s: %v", bf.path, err)
+		return policyVersion{}, err
+	}
+
+	return lb.policy(bf.compile), nil
+}
+
+// Health reports the bundle as ready if it can be read, verified and
+// compiled.
+func (bf *bundleFile) Health() Health {
+
+	lb, err := bf.load()
+	if err != nil {
+		return Health{LastError: err.Error()}
+	}
+
+	health := Health{Ready: true, Revision: lb.revision}
+	if info, err := os.Stat(bf.path); err == nil {
+		modified := info.ModTime().UTC()
+		health.LastReload = &modified
+	}
+
+	return health
+}
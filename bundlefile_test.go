@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/bundle"
+)
+
+// writeBundleArchive writes a bundle archive holding policy to path, signed
+// with the HS256 secret unless it is empty. The policy is replaced with
+// tampered after signing, unless it is empty.
+func writeBundleArchive(t *testing.T, path, revision, policy, secret, tampered string) {
+	t.Helper()
+
+	b := bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: revision},
+		Modules: []bundle.ModuleFile{
+			{URL: "/policy.rego", Path: "/policy.rego", Raw: []byte(policy)},
+		},
+		Data: map[string]interface{}{},
+	}
+	b.Manifest.Init()
+
+	if secret != "" {
+		if err := b.GenerateSignature(bundle.NewSigningConfig(secret, "HS256", ""), "default", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tampered != "" {
+		b.Modules[0].Raw = []byte(tampered)
+	}
+
+	var buf bytes.Buffer
+	if err := bundle.NewWriter(&buf).DisableFormat(true).Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthZReqPolicyBundle(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "authz.tar.gz")
+	allow := "package docker.authz\n\nallow if input.Method == \"GET\"\n"
+
+	bf, err := newBundleFile(path, "secret", "default", "HS256", compileOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plugin := DockerAuthZPlugin{
+		bundleFile:  bf,
+		allowPath:   "data.docker.authz.allow",
+		quiet:       true,
+		mode:        modeEnforce,
+		failureMode: failClosed,
+	}
+	get := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+	post := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}
+
+	writeBundleArchive(t, path, "r1", allow, "secret", "")
+
+	if response := plugin.AuthZReq(get); !response.Allow {
+		t.Errorf("Expected GET to be allowed by the signed bundle, got %+v", response)
+	}
+	response := plugin.AuthZReq(post)
+	if response.Allow || response.Msg != defaultDenyMessage+" [policy authz@r1]" {
+		t.Errorf("Expected POST to be denied by the signed bundle, got %+v", response)
+	}
+	if h := plugin.health(); !h.Ready || h.Revision != "authz@r1" {
+		t.Errorf("Expected signed bundle to be ready, got %+v", h)
+	}
+
+	tests := []struct {
+		note   string
+		secret string
+		err    string
+	}{
+		{note: "unsigned", err: "missing .signatures.json"},
+		{note: "signed with another key", secret: "other", err: "signature"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			writeBundleArchive(t, path, "r2", "package docker.authz\n\nallow := true\n", tc.secret, "")
+
+			response := plugin.AuthZReq(get)
+			if response.Allow || !strings.Contains(response.Err, tc.err) {
+				t.Errorf("Expected bundle to be refused with error %q, got %+v", tc.err, response)
+			}
+			if h := plugin.health(); h.Ready {
+				t.Errorf("Expected refused bundle not to be ready, got %+v", h)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		writeBundleArchive(t, path, "r1", allow, "secret", "package docker.authz\n\nallow := true\n")
+
+		response := plugin.AuthZReq(post)
+		if response.Allow || !strings.Contains(response.Err, "digest mismatch") {
+			t.Errorf("Expected tampered bundle to be refused, got %+v", response)
+		}
+	})
+
+	t.Run("failure mode open", func(t *testing.T) {
+		writeBundleArchive(t, path, "r3", allow, "", "")
+
+		open := plugin
+		open.failureMode = failOpen
+		if response := open.AuthZReq(post); !response.Allow {
+			t.Errorf("Expected unsigned bundle to fail open, got %+v", response)
+		}
+	})
+}
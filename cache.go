@@ -0,0 +1,228 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheLookupsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "opa_docker_authz",
+		Name:      "decision_cache_lookups_total",
+		Help:      "Number of decision cache lookups for cacheable requests, by result.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(cacheLookupsTotal)
+}
+
+// defaultCacheRules lists the read-only requests commonly polled by tools.
+const defaultCacheRules = "GET:/_ping,HEAD:/_ping,GET:/version,GET:/info,GET:/containers/json,GET:/images/json"
+
+// cacheRule marks requests with the given method, and an API path (without
+// the version prefix) matching the glob, as cacheable.
+type cacheRule struct {
+	method string
+	path   glob.Glob
+}
+
+// parseCacheRules parses a comma separated list of METHOD:path-glob rules,
+// e.g. "GET:/containers/json,HEAD:/_ping".
+func parseCacheRules(s string) ([]cacheRule, error) {
+
+	var rules []cacheRule
+
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		method, path, ok := strings.Cut(rule, ":")
+		if !ok || method == "" || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("invalid cache rule %q, expected METHOD:/path", rule)
+		}
+
+		g, err := glob.Compile(path, '/')
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache rule %q: %w", rule, err)
+		}
+
+		rules = append(rules, cacheRule{strings.ToUpper(method), g})
+	}
+
+	return rules, nil
+}
+
+type cacheEntry struct {
+	key      string
+	decision decision
+	expires  time.Time
+}
+
+// decisionCache is an LRU cache of policy decisions for cacheable requests.
+// Entries are keyed by the policy revision and the input document, and are
+// dropped altogether as soon as a lookup is made with a different revision.
+// A nil *decisionCache caches nothing.
+type decisionCache struct {
+	mtx      sync.Mutex
+	size     int
+	ttl      time.Duration
+	rules    []cacheRule
+	revision string
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func newDecisionCache(size int, ttl time.Duration, rules []cacheRule) *decisionCache {
+	return &decisionCache{
+		size:    size,
+		ttl:     ttl,
+		rules:   rules,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// cacheable reports whether decisions for the request may be cached.
+func (c *decisionCache) cacheable(method, path string) bool {
+
+	if c == nil {
+		return false
+	}
+
+	path = apiPath(path)
+	for _, rule := range c.rules {
+		if rule.method == method && rule.path.Match(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// key returns the cache key of an input document under a policy revision.
+func (*decisionCache) key(revision string, input interface{}) (string, error) {
+
+	bs, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(revision))
+	h.Write([]byte{0})
+	h.Write(bs)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// get returns the cached decision for key. All entries are dropped if the
+// policy revision changed since the last lookup.
+func (c *decisionCache) get(revision, key string) (decision, bool) {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if revision != c.revision {
+		c.entries = map[string]*list.Element{}
+		c.order.Init()
+		c.revision = revision
+	}
+
+	elem, ok := c.entries[key]
+	if !ok {
+		cacheLookupsTotal.WithLabelValues("miss").Inc()
+		return decision{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		cacheLookupsTotal.WithLabelValues("miss").Inc()
+		return decision{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	cacheLookupsTotal.WithLabelValues("hit").Inc()
+	return entry.decision, true
+}
+
+// add caches a decision made under the given policy revision, evicting the
+// least recently used entry if the cache is full.
+func (c *decisionCache) add(revision, key string, d decision) {
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if revision != c.revision {
+		return
+	}
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	for c.order.Len() > 0 && c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, d, time.Now().Add(c.ttl)})
+}
+
+// storeGeneration counts the commits made to an OPA store, so that cached
+// decisions can be tied to the policy and data they were made with. A nil
+// *storeGeneration is always at generation zero.
+type storeGeneration struct {
+	n atomic.Uint64
+}
+
+// watchStore registers a trigger counting the commits made to store.
+func watchStore(ctx context.Context, store storage.Store) (*storeGeneration, error) {
+
+	g := &storeGeneration{}
+
+	err := storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		_, err := store.Register(ctx, txn, storage.TriggerConfig{
+			OnCommit: func(context.Context, storage.Transaction, storage.TriggerEvent) {
+				g.n.Add(1)
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (g *storeGeneration) String() string {
+	if g == nil {
+		return "0"
+	}
+	return strconv.FormatUint(g.n.Load(), 10)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+)
+
+func TestParseCacheRules(t *testing.T) {
+	rules, err := parseCacheRules(defaultCacheRules + ", get:/containers/*/json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	cache := newDecisionCache(10, time.Minute, rules)
+
+	tests := []struct {
+		method    string
+		uri       string
+		cacheable bool
+	}{
+		{"GET", "/v1.47/containers/json?all=1", true},
+		{"GET", "/containers/json", true},
+		{"HEAD", "/_ping", true},
+		{"GET", "/v1.47/containers/abc/json", true},
+		{"POST", "/v1.47/containers/create", false},
+		{"GET", "/v1.47/containers/abc/logs", false},
+		{"DELETE", "/v1.47/containers/json", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.uri, func(t *testing.T) {
+			if got := cache.cacheable(tc.method, tc.uri); got != tc.cacheable {
+				t.Errorf("Expected cacheable: %v, got %v", tc.cacheable, got)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"GET", "GET:containers/json", ":/_ping"} {
+		if _, err := parseCacheRules(invalid); err == nil {
+			t.Errorf("Expected error for rule %q", invalid)
+		}
+	}
+}
+
+func TestDecisionCache(t *testing.T) {
+	t.Run("evicts least recently used entries", func(t *testing.T) {
+		cache := newDecisionCache(2, time.Minute, nil)
+		cache.get("rev", "")
+		cache.add("rev", "a", decision{allow: true})
+		cache.add("rev", "b", decision{allow: true})
+		cache.get("rev", "a")
+		cache.add("rev", "c", decision{allow: false})
+
+		if _, ok := cache.get("rev", "b"); ok {
+			t.Errorf("Expected b to be evicted")
+		}
+		if d, ok := cache.get("rev", "a"); !ok || !d.allow {
+			t.Errorf("Expected a to be cached")
+		}
+		if d, ok := cache.get("rev", "c"); !ok || d.allow {
+			t.Errorf("Expected c to be cached")
+		}
+	})
+
+	t.Run("expires entries", func(t *testing.T) {
+		cache := newDecisionCache(2, -time.Second, nil)
+		cache.get("rev", "")
+		cache.add("rev", "a", decision{allow: true})
+		if _, ok := cache.get("rev", "a"); ok {
+			t.Errorf("Expected a to be expired")
+		}
+	})
+
+	t.Run("invalidates entries on revision change", func(t *testing.T) {
+		cache := newDecisionCache(2, time.Minute, nil)
+		cache.get("rev1", "")
+		cache.add("rev1", "a", decision{allow: true})
+		if _, ok := cache.get("rev2", "a"); ok {
+			t.Errorf("Expected a to be invalidated")
+		}
+		cache.add("rev1", "b", decision{allow: true})
+		if _, ok := cache.get("rev2", "b"); ok {
+			t.Errorf("Expected decision of stale revision not to be cached")
+		}
+	})
+}
+
+func TestEvaluateCachedDecision(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	writePolicy := func(allow bool) {
+		policy := "package docker.authz\n\ndefault allow := false\n"
+		if allow {
+			policy += "\nallow := true\n"
+		}
+		if err := os.WriteFile(policyFile, []byte(policy), 0o600); err != nil {
+			t.Fatalf("Failed to write policy - got %v", err)
+		}
+	}
+
+	rules, _ := parseCacheRules(defaultCacheRules)
+	plugin := DockerAuthZPlugin{
+		policyFile: policyFile,
+		allowPath:  "data.docker.authz.allow",
+		instanceID: "test-instance",
+		quiet:      true,
+		cache:      newDecisionCache(10, time.Minute, rules),
+	}
+	request := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+
+	writePolicy(true)
+	if allowed, _ := plugin.evaluate(context.Background(), request); !allowed {
+		t.Fatalf("Expected request to be allowed")
+	}
+	hits := counterValue(t, cacheLookupsTotal.WithLabelValues("hit"))
+	if allowed, _ := plugin.evaluate(context.Background(), request); !allowed {
+		t.Fatalf("Expected request to be allowed")
+	}
+	if got := counterValue(t, cacheLookupsTotal.WithLabelValues("hit")) - hits; got != 1 {
+		t.Errorf("Expected one cache hit, got %v", got)
+	}
+
+	writePolicy(false)
+	if allowed, _ := plugin.evaluate(context.Background(), request); allowed {
+		t.Errorf("Expected changed policy to invalidate the cached decision")
+	}
+}
+
+func TestWatchStore(t *testing.T) {
+	ctx := context.Background()
+	store := inmem.New()
+
+	generation, err := watchStore(ctx, store)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	before := generation.String()
+
+	err = storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		return store.UpsertPolicy(ctx, txn, "policy.rego", []byte("package x"))
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if generation.String() == before {
+		t.Errorf("Expected generation to change after commit, still %s", before)
+	}
+}
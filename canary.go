@@ -0,0 +1,119 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	candidateDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "opa_docker_authz",
+			Name:      "candidate_decisions_total",
+			Help:      "Number of decisions made by the candidate policy, by result.",
+		},
+		[]string{"result"},
+	)
+	candidateDisagreementsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "opa_docker_authz",
+			Name:      "candidate_disagreements_total",
+			Help:      "Number of requests for which the candidate policy disagreed with the enforced policy.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(candidateDecisionsTotal, candidateDisagreementsTotal)
+}
+
+// outcome is the result of a single policy evaluation.
+type outcome struct {
+	allowed bool
+	err     error
+}
+
+// candidatePolicy is a policy file evaluated alongside the enforced policy.
+// Its decisions are compared with the enforced ones, but never acted upon.
+type candidatePolicy struct {
+	policyFile string
+	allowPath  string
+	timeout    time.Duration
+	compile    compileOptions
+}
+
+// inputBuilder builds the input document of a request.
+type inputBuilder func(context.Context, authorization.Request) (map[string]interface{}, error)
+
+// evaluate evaluates the candidate policy for the request, giving up after
+// the configured timeout regardless of the deadline of the request context.
+func (c *candidatePolicy) evaluate(ctx context.Context, r authorization.Request, buildInput inputBuilder) (interface{}, outcome) {
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.timeout)
+	defer cancel()
+
+	input, err := buildInput(ctx, r)
+	if err != nil {
+		return nil, outcome{false, err}
+	}
+
+	bs, err := os.ReadFile(c.policyFile)
+	if err != nil {
+		return input, outcome{false, err}
+	}
+
+	d, err := evalModule(ctx, c.compile, c.allowPath, c.policyFile, bs, input)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	return input, outcome{d.allow, err}
+}
+
+// compare evaluates the candidate policy and, once the enforced outcome is
+// received, records whether both policies agreed. Candidate evaluations that
+// time out are not compared.
+func (c *candidatePolicy) compare(ctx context.Context, r authorization.Request, buildInput inputBuilder, enforced <-chan outcome) {
+
+	input, candidate := c.evaluate(ctx, r, buildInput)
+	actual := <-enforced
+
+	if errors.Is(candidate.err, context.DeadlineExceeded) {
+		candidateDecisionsTotal.WithLabelValues(resultTimeout).Inc()
+		log.Printf("Candidate policy evaluation timed out after %v", c.timeout)
+		return
+	}
+	candidateDecisionsTotal.WithLabelValues(decisionResult(candidate.allowed, candidate.err)).Inc()
+
+	if candidate.allowed == actual.allowed {
+		return
+	}
+	candidateDisagreementsTotal.Inc()
+
+	disagreement := map[string]interface{}{
+		"input":            input,
+		"enforced_result":  actual.allowed,
+		"candidate_result": candidate.allowed,
+		"timestamp":        time.Now().Format(time.RFC3339Nano),
+	}
+	if actual.err != nil {
+		disagreement["enforced_error"] = actual.err.Error()
+	}
+	if candidate.err != nil {
+		disagreement["candidate_error"] = candidate.err.Error()
+	}
+
+	dl, _ := json.Marshal(disagreement)
+	log.Printf("Candidate policy disagreed with enforced policy: %s", string(dl))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("Failed to read counter - got %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatalf("Failed to read gauge - got %v", err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestCandidatePolicyCompare(t *testing.T) {
+	tests := []struct {
+		name                 string
+		policyFile           string
+		enforced             outcome
+		timeout              time.Duration
+		expectedDisagreement bool
+		expectedResult       string
+	}{
+		{
+			name:           "agreement",
+			enforced:       outcome{allowed: true},
+			timeout:        time.Second,
+			expectedResult: resultAllow,
+		},
+		{
+			name:                 "disagreement",
+			enforced:             outcome{allowed: false},
+			timeout:              time.Second,
+			expectedDisagreement: true,
+			expectedResult:       resultAllow,
+		},
+		{
+			name:                 "disagreement with enforced error",
+			enforced:             outcome{allowed: false, err: errors.New("boom")},
+			timeout:              time.Second,
+			expectedDisagreement: true,
+			expectedResult:       resultAllow,
+		},
+		{
+			name:           "timeout",
+			policyFile:     "testdata/slow.rego",
+			enforced:       outcome{allowed: true},
+			timeout:        10 * time.Millisecond,
+			expectedResult: resultTimeout,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			policyFile := tc.policyFile
+			if policyFile == "" {
+				policyFile = "testdata/default_allow.rego"
+			}
+			candidate := &candidatePolicy{
+				policyFile: policyFile,
+				allowPath:  "data.docker.authz.allow",
+				timeout:    tc.timeout,
+			}
+			request := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+
+			disagreements := counterValue(t, candidateDisagreementsTotal)
+			results := counterValue(t, candidateDecisionsTotal.WithLabelValues(tc.expectedResult))
+
+			enforced := make(chan outcome, 1)
+			enforced <- tc.enforced
+			candidate.compare(context.Background(), request, DockerAuthZPlugin{}.buildInput, enforced)
+
+			if got := counterValue(t, candidateDisagreementsTotal) - disagreements; (got == 1) != tc.expectedDisagreement {
+				t.Errorf("Expected disagreement: %v, got %v new disagreements", tc.expectedDisagreement, got)
+			}
+			if got := counterValue(t, candidateDecisionsTotal.WithLabelValues(tc.expectedResult)) - results; got != 1 {
+				t.Errorf("Expected one %s candidate decision, got %v", tc.expectedResult, got)
+			}
+		})
+	}
+}
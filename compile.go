@@ -0,0 +1,157 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/bundle"
+	"github.com/open-policy-agent/opa/v1/plugins"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/storage"
+)
+
+// compileOptions restricts how policies are compiled: to the built-in
+// functions and features of an OPA capabilities file, in strict mode, and
+// for a Rego version. The zero value compiles with the defaults of OPA.
+type compileOptions struct {
+	capabilities *ast.Capabilities
+	strict       bool
+	regoVersion  ast.RegoVersion
+}
+
+// newCompileOptions loads the capabilities file, if any, and checks that the
+// Rego library shipped with the plugin compiles under the options. The
+// Docker-aware built-in functions of the plugin are always allowed.
+func newCompileOptions(capabilitiesFile string, strict bool, regoVersion string) (compileOptions, error) {
+
+	c := compileOptions{strict: strict}
+
+	switch regoVersion {
+	case "v0":
+		c.regoVersion = ast.RegoV0
+	case "v1":
+		c.regoVersion = ast.RegoV1
+	default:
+		return c, fmt.Errorf("invalid Rego version %q, must be one of v0 or v1", regoVersion)
+	}
+
+	if capabilitiesFile != "" {
+		caps, err := ast.LoadCapabilitiesFile(capabilitiesFile)
+		if err != nil {
+			return c, fmt.Errorf("invalid capabilities file %s: %w", capabilitiesFile, err)
+		}
+		for _, bi := range ast.Builtins {
+			if strings.HasPrefix(bi.Name, "docker.") {
+				caps.Builtins = append(caps.Builtins, bi)
+			}
+		}
+		c.capabilities = caps
+	}
+
+	if err := c.compile(map[string]*ast.Module{}); err != nil {
+		return c, fmt.Errorf("the docker.lib Rego library does not compile with the capabilities and strict mode: %w", err)
+	}
+
+	return c, nil
+}
+
+// restricted reports whether the options differ from the defaults of OPA in
+// anything but the Rego version.
+func (c compileOptions) restricted() bool {
+	return c.capabilities != nil || c.strict
+}
+
+func (c compileOptions) parserOptions() ast.ParserOptions {
+	return ast.ParserOptions{
+		Capabilities:      c.capabilities,
+		RegoVersion:       c.regoVersion,
+		ProcessAnnotation: true,
+	}
+}
+
+// regoOptions returns the options evaluating a policy in-process under the
+// options, alongside the Rego library.
+func (c compileOptions) regoOptions() []func(*rego.Rego) {
+
+	options := libOptions()
+	if c.capabilities != nil {
+		options = append(options, rego.Capabilities(c.capabilities))
+	}
+	if c.strict {
+		options = append(options, rego.Strict(true))
+	}
+	if c.regoVersion != ast.RegoUndefined {
+		options = append(options, rego.SetRegoVersion(c.regoVersion))
+	}
+
+	return options
+}
+
+// compile compiles the modules of a policy, along with the Rego library,
+// returning all compilation errors.
+func (c compileOptions) compile(modules map[string]*ast.Module) error {
+
+	compiler := ast.NewCompiler().SetErrorLimit(0).WithStrict(c.strict)
+	if c.capabilities != nil {
+		compiler = compiler.WithCapabilities(c.capabilities)
+	}
+
+	if compiler.Compile(withLib(modules)); compiler.Failed() {
+		return compiler.Errors
+	}
+
+	return nil
+}
+
+// bundleReader configures a bundle reader to parse policies under the
+// options.
+func (c compileOptions) bundleReader(reader *bundle.Reader) *bundle.Reader {
+
+	if c.capabilities != nil {
+		reader = reader.WithCapabilities(c.capabilities)
+	}
+	if c.regoVersion != ast.RegoUndefined {
+		reader = reader.WithRegoVersion(c.regoVersion)
+	}
+
+	return reader
+}
+
+// recompile compiles the policies activated by the OPA SDK again under the
+// options, since the OPA SDK compiles bundles with the defaults of OPA. Each
+// policy is parsed for the Rego version it was activated with.
+func (c compileOptions) recompile(ctx context.Context, store storage.Store, txn storage.Transaction, compiled *ast.Compiler) error {
+
+	lib, _ := libSources()
+	modules := map[string]*ast.Module{}
+	for id, m := range compiled.Modules {
+		if _, ok := lib[id]; ok {
+			continue
+		}
+		bs, err := store.GetPolicy(ctx, txn, id)
+		if err != nil {
+			return err
+		}
+		opts := c.parserOptions()
+		opts.RegoVersion = m.RegoVersion()
+		module, err := ast.ParseModuleWithOpts(id, string(bs), opts)
+		if err != nil {
+			return err
+		}
+		modules[id] = module
+	}
+
+	return c.compile(modules)
+}
+
+// managerOption returns an option for the OPA plugin manager of config-file
+// mode, parsing bundles for the Rego version.
+func (c compileOptions) managerOption() func(*plugins.Manager) {
+	return plugins.WithParserOptions(ast.ParserOptions{RegoVersion: c.regoVersion})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/ast"
+)
+
+const networkPolicy = `package docker.authz
+
+default allow := false
+
+allow if input.Method == "GET"
+
+remote := http.send({"method": "GET", "url": "http://localhost:1"})
+`
+
+const v0Policy = `package docker.authz
+
+default allow = false
+
+allow { input.Method == "GET" }
+`
+
+// writeCapabilities writes the capabilities of this version of OPA, without
+// the named built-in functions, to a file in dir.
+func writeCapabilities(t *testing.T, dir string, without ...string) string {
+	t.Helper()
+
+	caps := ast.CapabilitiesForThisVersion()
+	builtins := caps.Builtins[:0]
+	for _, bi := range caps.Builtins {
+		forbidden := false
+		for _, name := range without {
+			forbidden = forbidden || bi.Name == name
+		}
+		if !forbidden {
+			builtins = append(builtins, bi)
+		}
+	}
+	caps.Builtins = builtins
+
+	bs, err := json.Marshal(caps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "capabilities.json")
+	if err := os.WriteFile(file, bs, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestNewCompileOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	invalid := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"builtins": {}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	libDir := filepath.Join(dir, "lib")
+	if err := os.Mkdir(libDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		note         string
+		capabilities string
+		regoVersion  string
+		wantErr      string
+	}{
+		{note: "defaults", regoVersion: "v1"},
+		{note: "v0", regoVersion: "v0"},
+		{note: "invalid rego version", regoVersion: "v2", wantErr: "invalid Rego version"},
+		{note: "capabilities", capabilities: writeCapabilities(t, dir, "http.send"), regoVersion: "v1"},
+		{note: "missing capabilities file", capabilities: filepath.Join(dir, "missing.json"), regoVersion: "v1", wantErr: "invalid capabilities file"},
+		{note: "invalid capabilities file", capabilities: invalid, regoVersion: "v1", wantErr: "invalid capabilities file"},
+		{note: "capabilities forbidding the library", capabilities: writeCapabilities(t, libDir, "regex.replace"), regoVersion: "v1", wantErr: "docker.lib"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			_, err := newCompileOptions(tc.capabilities, false, tc.regoVersion)
+			if tc.wantErr == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("Expected error containing %q, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRegoSyntaxCompileOptions(t *testing.T) {
+	dir := t.TempDir()
+
+	network := filepath.Join(dir, "network.rego")
+	unused := filepath.Join(dir, "unused.rego")
+	v0 := filepath.Join(dir, "v0.rego")
+	for file, policy := range map[string]string{
+		network: networkPolicy,
+		unused:  "package docker.authz\n\nimport data.docker.lib\n\nallow if input.Method == \"GET\"\n",
+		v0:      v0Policy,
+	} {
+		if err := os.WriteFile(file, []byte(policy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capabilities := writeCapabilities(t, dir, "http.send")
+
+	tests := []struct {
+		note         string
+		file         string
+		capabilities string
+		strict       bool
+		regoVersion  string
+		expected     int
+	}{
+		{note: "network allowed", file: network, regoVersion: "v1", expected: 0},
+		{note: "network forbidden", file: network, capabilities: capabilities, regoVersion: "v1", expected: 1},
+		{note: "unused import", file: unused, regoVersion: "v1", expected: 0},
+		{note: "unused import strict", file: unused, strict: true, regoVersion: "v1", expected: 1},
+		{note: "v0 policy", file: v0, regoVersion: "v0", expected: 0},
+		{note: "v0 policy parsed as v1", file: v0, regoVersion: "v1", expected: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			c, err := newCompileOptions(tc.capabilities, tc.strict, tc.regoVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code := regoSyntax(tc.file, c); code != tc.expected {
+				t.Errorf("Expected exit code %d, got %d", tc.expected, code)
+			}
+		})
+	}
+}
+
+func TestAuthZReqCapabilities(t *testing.T) {
+	c, err := newCompileOptions(writeCapabilities(t, t.TempDir(), "http.send"), false, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+
+	for name, plugin := range compiledSources(t, networkPolicy, c) {
+		t.Run(name, func(t *testing.T) {
+			if response := plugin.AuthZReq(get); response.Allow || response.Err == "" {
+				t.Errorf("Expected the policy to be refused, got %+v", response)
+			}
+			if h := plugin.health(); h.Ready || !strings.Contains(h.LastError, "http.send") {
+				t.Errorf("Expected the policy not to be ready, got %+v", h)
+			}
+		})
+	}
+
+	for name, plugin := range paritySources(t, networkPolicy) {
+		t.Run(name+" without capabilities", func(t *testing.T) {
+			if response := plugin.AuthZReq(get); !response.Allow {
+				t.Errorf("Expected GET to be allowed, got %+v", response)
+			}
+		})
+	}
+}
+
+func TestAuthZReqRegoVersion(t *testing.T) {
+	c, err := newCompileOptions("", false, "v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, plugin := range compiledSources(t, v0Policy, c) {
+		t.Run(name, func(t *testing.T) {
+			response := plugin.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"})
+			if !response.Allow {
+				t.Errorf("Expected GET to be allowed, got %+v", response)
+			}
+			response = plugin.AuthZReq(authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"})
+			if response.Allow || response.Err != "" {
+				t.Errorf("Expected POST to be denied, got %+v", response)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/server/types"
+)
+
+// defaultDenyMessage is returned to clients when the policy denies a request
+// without giving a reason.
+const defaultDenyMessage = "request rejected by administrative policy"
+
+// decision is the outcome of the policy for a request. Policies decide either
+// with a boolean, or with an object like {"allow": false, "reason": "..."},
+// where the optional reason is returned to the client of denied requests,
+// "break_glass": false keeps break-glass tokens from overriding a denial, and
+// "requires_approval": true queues a denied request for approval.
+//
+// Decisions may also carry advice: "warnings", a set of messages returned to
+// the client of denied requests and logged with the decision (the Docker
+// daemon drops the message of allowed requests, so their warnings only reach
+// the decision log), and "log_level" and "tags", controlling how the decision
+// is logged.
+type decision struct {
+	allow            bool
+	reason           string
+	refuseBreakGlass bool
+	requiresApproval bool
+
+	warnings []string
+	logLevel string
+	tags     map[string]interface{}
+
+	// revision identifies the policy that made the decision.
+	revision string
+
+	// id is the ID of the decision assigned by the OPA SDK, if any.
+	id string
+}
+
+// parseDecision parses the value of the allow decision of a policy.
+func parseDecision(v interface{}) (decision, error) {
+
+	switch v := v.(type) {
+	case bool:
+		return decision{allow: v}, nil
+	case map[string]interface{}:
+		allow, ok := v["allow"].(bool)
+		if !ok {
+			return decision{}, fmt.Errorf("administrative policy decision invalid: missing allow boolean")
+		}
+		d := decision{allow: allow}
+		if reason, ok := v["reason"]; ok {
+			if d.reason, ok = reason.(string); !ok {
+				return decision{}, fmt.Errorf("administrative policy decision invalid: reason must be a string")
+			}
+		}
+		if breakGlass, ok := v["break_glass"]; ok {
+			permitted, ok := breakGlass.(bool)
+			if !ok {
+				return decision{}, fmt.Errorf("administrative policy decision invalid: break_glass must be a boolean")
+			}
+			d.refuseBreakGlass = !permitted
+		}
+		if requiresApproval, ok := v["requires_approval"]; ok {
+			if d.requiresApproval, ok = requiresApproval.(bool); !ok {
+				return decision{}, fmt.Errorf("administrative policy decision invalid: requires_approval must be a boolean")
+			}
+		}
+		if warnings, ok := v["warnings"]; ok {
+			list, ok := warnings.([]interface{})
+			if !ok {
+				return decision{}, fmt.Errorf("administrative policy decision invalid: warnings must be a set of strings")
+			}
+			for _, w := range list {
+				msg, ok := w.(string)
+				if !ok {
+					return decision{}, fmt.Errorf("administrative policy decision invalid: warnings must be a set of strings")
+				}
+				d.warnings = append(d.warnings, msg)
+			}
+		}
+		if logLevel, ok := v["log_level"]; ok {
+			level, ok := logLevel.(string)
+			if _, valid := logLevels[level]; !ok || !valid {
+				return decision{}, fmt.Errorf("administrative policy decision invalid: log_level must be one of debug, info, warn or error")
+			}
+			d.logLevel = level
+		}
+		if tags, ok := v["tags"]; ok {
+			if d.tags, ok = tags.(map[string]interface{}); !ok {
+				return decision{}, fmt.Errorf("administrative policy decision invalid: tags must be an object")
+			}
+		}
+		return d, nil
+	}
+
+	return decision{}, fmt.Errorf("administrative policy decision invalid")
+}
+
+// message returns the message returned to the client of a denied request,
+// naming the revision of the policy that denied it.
+func (d decision) message() string {
+
+	msg := d.reason
+	if msg == "" {
+		msg = defaultDenyMessage
+	}
+	if d.revision != "" {
+		msg += " [policy " + d.revision + "]"
+	}
+	if len(d.warnings) > 0 {
+		msg += " (" + d.warningMessage() + ")"
+	}
+
+	return msg
+}
+
+// warningMessage returns the warnings of the policy, set as the message of
+// allowed requests. The Docker daemon does not pass it on to the client.
+func (d decision) warningMessage() string {
+	return strings.Join(d.warnings, "; ")
+}
+
+// Levels of decision logs. Decisions are logged at the info level unless the
+// policy sets another log_level.
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+	logLevelError = "error"
+)
+
+var logLevels = map[string]int{
+	logLevelDebug: 0,
+	logLevelInfo:  1,
+	logLevelWarn:  2,
+	logLevelError: 3,
+}
+
+// level returns the level the decision is logged at.
+func (d decision) level() string {
+	if d.logLevel == "" {
+		return logLevelInfo
+	}
+	return d.logLevel
+}
+
+// logsDecision reports whether a successfully evaluated decision is logged.
+// Decisions below the minimum log level of the plugin are never logged, and
+// -quiet and -log-only-denied only apply to debug and info decisions, so
+// policies can always surface warn and error decisions.
+func (p DockerAuthZPlugin) logsDecision(d decision) bool {
+
+	minLevel := p.logLevel
+	if minLevel == "" {
+		minLevel = logLevelInfo
+	}
+
+	level := logLevels[d.level()]
+	if level < logLevels[minLevel] {
+		return false
+	}
+	if level <= logLevels[logLevelInfo] {
+		return !p.quiet && (!p.logOnlyDenied || !d.allow)
+	}
+
+	return true
+}
+
+// policyFileRevision returns the revision of a policy file with the given
+// SHA-256 hex digest.
+func policyFileRevision(digest string) string {
+	return "sha256:" + digest[:12]
+}
+
+// bundleRevision returns the revisions of the bundles that produced a
+// decision in config-file mode, e.g. authz@v1.2.0,data@42.
+func bundleRevision(provenance types.ProvenanceV1) string {
+
+	revisions := make([]string, 0, len(provenance.Bundles))
+	for name, b := range provenance.Bundles {
+		revisions = append(revisions, name+"@"+b.Revision)
+	}
+	sort.Strings(revisions)
+
+	return strings.Join(revisions, ",")
+}
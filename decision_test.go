@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/server/types"
+)
+
+func TestParseDecision(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected decision
+		err      bool
+	}{
+		{true, decision{allow: true}, false},
+		{false, decision{}, false},
+		{map[string]interface{}{"allow": true}, decision{allow: true}, false},
+		{map[string]interface{}{"allow": false, "reason": "no"}, decision{reason: "no"}, false},
+		{map[string]interface{}{"reason": "no"}, decision{}, true},
+		{map[string]interface{}{"allow": false, "reason": 1}, decision{}, true},
+		{"allow", decision{}, true},
+		{
+			map[string]interface{}{"allow": true, "warnings": []interface{}{"tag latest is deprecated"}, "log_level": "warn", "tags": map[string]interface{}{"team": "web"}},
+			decision{allow: true, warnings: []string{"tag latest is deprecated"}, logLevel: logLevelWarn, tags: map[string]interface{}{"team": "web"}},
+			false,
+		},
+		{map[string]interface{}{"allow": true, "warnings": "deprecated"}, decision{}, true},
+		{map[string]interface{}{"allow": true, "warnings": []interface{}{1}}, decision{}, true},
+		{map[string]interface{}{"allow": true, "log_level": "trace"}, decision{}, true},
+		{map[string]interface{}{"allow": true, "tags": []interface{}{"web"}}, decision{}, true},
+	}
+
+	for _, tc := range tests {
+		d, err := parseDecision(tc.value)
+		if (err != nil) != tc.err {
+			t.Errorf("Expected error: %v for %v, got %v", tc.err, tc.value, err)
+		}
+		if !reflect.DeepEqual(d, tc.expected) {
+			t.Errorf("Expected %+v for %v, got %+v", tc.expected, tc.value, d)
+		}
+	}
+
+	if msg := (decision{}).message(); msg != defaultDenyMessage {
+		t.Errorf("Expected default message, got %q", msg)
+	}
+	if msg := (decision{reason: "no", warnings: []string{"a", "b"}}).message(); msg != "no (a; b)" {
+		t.Errorf("Expected message with warnings, got %q", msg)
+	}
+}
+
+func TestLogsDecision(t *testing.T) {
+	tests := []struct {
+		note     string
+		plugin   DockerAuthZPlugin
+		decision decision
+		expected bool
+	}{
+		{note: "info", decision: decision{allow: true}, expected: true},
+		{note: "debug", decision: decision{allow: true, logLevel: logLevelDebug}, expected: false},
+		{note: "debug level", plugin: DockerAuthZPlugin{logLevel: logLevelDebug}, decision: decision{logLevel: logLevelDebug}, expected: true},
+		{note: "quiet", plugin: DockerAuthZPlugin{quiet: true}, decision: decision{}, expected: false},
+		{note: "quiet warn", plugin: DockerAuthZPlugin{quiet: true}, decision: decision{allow: true, logLevel: logLevelWarn}, expected: true},
+		{note: "only denied", plugin: DockerAuthZPlugin{logOnlyDenied: true}, decision: decision{allow: true}, expected: false},
+		{note: "only denied error", plugin: DockerAuthZPlugin{logOnlyDenied: true}, decision: decision{allow: true, logLevel: logLevelError}, expected: true},
+		{note: "below minimum", plugin: DockerAuthZPlugin{logLevel: logLevelError}, decision: decision{logLevel: logLevelWarn}, expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			if got := tc.plugin.logsDecision(tc.decision); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAuthZReqWarnings(t *testing.T) {
+	policy := `package docker.authz
+
+allow := {"allow": input.Method == "GET", "warnings": warnings, "log_level": "warn", "tags": {"team": "web"}}
+
+warnings contains "tag latest is deprecated"
+
+warnings contains "containers must set a memory limit"
+`
+
+	for name, plugin := range paritySources(t, policy) {
+		t.Run(name, func(t *testing.T) {
+			res := plugin.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"})
+			if !res.Allow || res.Msg != "containers must set a memory limit; tag latest is deprecated" {
+				t.Errorf("Expected allowed request with warnings, got %+v", res)
+			}
+
+			res = plugin.AuthZReq(authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"})
+			if res.Allow || !strings.HasSuffix(res.Msg, "] (containers must set a memory limit; tag latest is deprecated)") {
+				t.Errorf("Expected denied request with warnings, got %+v", res)
+			}
+		})
+	}
+}
+
+func TestDecisionRevision(t *testing.T) {
+	provenance := types.ProvenanceV1{Bundles: map[string]types.ProvenanceBundleV1{
+		"data":  {Revision: "42"},
+		"authz": {Revision: "v1.2.0"},
+	}}
+	if got := bundleRevision(provenance); got != "authz@v1.2.0,data@42" {
+		t.Errorf("Expected bundle revisions, got %q", got)
+	}
+	if got := bundleRevision(types.ProvenanceV1{}); got != "" {
+		t.Errorf("Expected no revision without bundles, got %q", got)
+	}
+
+	d := decision{reason: "no", revision: "authz@v1.2.0"}
+	if msg := d.message(); msg != "no [policy authz@v1.2.0]" {
+		t.Errorf("Expected message naming the revision, got %q", msg)
+	}
+
+	plugin := DockerAuthZPlugin{policyFile: "example.rego", allowPath: "data.docker.authz.allow", quiet: true}
+	res := plugin.AuthZReq(authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"})
+
+	bs, err := os.ReadFile("example.rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(bs)
+	revision := policyFileRevision(hex.EncodeToString(digest[:]))
+
+	if res.Allow || res.Msg != defaultDenyMessage+" [policy "+revision+"]" {
+		t.Errorf("Expected denial naming the policy revision, got %+v", res)
+	}
+	if got := gaugeValue(t, policyInfo.WithLabelValues(revision)); got != 1 {
+		t.Errorf("Expected policy info for revision %s, got %v", revision, got)
+	}
+}
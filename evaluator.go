@@ -0,0 +1,158 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/open-policy-agent/opa/v1/sdk"
+)
+
+var errNoPolicy = errors.New("no policy file or config file configured")
+
+// Evaluator is a source of the policy deciding requests. Requests are decided
+// the same way whatever the source: the plugin builds the input, caches and
+// logs decisions, and applies timeouts and the failure mode.
+type Evaluator interface {
+	// Policy returns the version of the policy deciding requests, or an
+	// error if no version can be activated.
+	Policy(ctx context.Context) (policyVersion, error)
+
+	// Health reports the state of the policy.
+	Health() Health
+}
+
+// policyVersion is a version of the policy, as returned by an Evaluator.
+type policyVersion struct {
+	// hash identifies the policy and data the decisions are made with, keying
+	// cached decisions.
+	hash string
+
+	// revision identifies the policy in decisions that do not carry their
+	// own revision.
+	revision string
+
+	// eval evaluates the allow decision at query, a data.* reference. An
+	// undefined decision denies the request.
+	eval func(ctx context.Context, query string, input interface{}) (decision, error)
+}
+
+// evaluator returns the source of the policy configured for the plugin.
+func (p DockerAuthZPlugin) evaluator() Evaluator {
+
+	switch {
+	case p.configFile != "":
+		return sdkEvaluator{opa: p.opa, generation: p.generation, startup: p.startup, tracker: p.policyHealth, compile: p.compile}
+	case p.bundleFile != nil:
+		return p.bundleFile
+	case p.policyDir != nil:
+		return p.policyDir
+	}
+
+	return regoFile{path: p.policyFile, compile: p.compile}
+}
+
+// regoFile is a single Rego policy file, read again for every request. While
+// the file does not exist, requests are decided by the embedded fallback
+// policy if there is one.
+type regoFile struct {
+	path    string
+	compile compileOptions
+}
+
+func (f regoFile) Policy(context.Context) (policyVersion, error) {
+
+	bs, err := os.ReadFile(f.path)
+	if err != nil {
+		if fb, _ := embeddedFallback(); fb != nil && os.IsNotExist(err) {
+			if !fallbackActive.Swap(true) {
+				log.Printf("OPA policy file %q does not exist, deciding requests with the embedded fallback policy %s", f.path, fb.revision)
+			}
+			return fb.policy(f.compile), nil
+		}
+		if f.path == "" {
+			return policyVersion{}, errNoPolicy
+		}
+		return policyVersion{}, err
+	}
+	if fallbackActive.Swap(false) {
+		log.Printf("OPA policy file %s found, the embedded fallback policy is no longer active", f.path)
+	}
+
+	sum := sha256.Sum256(bs)
+	hash := hex.EncodeToString(sum[:])
+
+	return policyVersion{
+		hash:     hash,
+		revision: policyFileRevision(hash),
+		eval: func(ctx context.Context, query string, input interface{}) (decision, error) {
+			return evalModule(ctx, f.compile, query, f.path, bs, input)
+		},
+	}, nil
+}
+
+func (f regoFile) Health() Health {
+	return policyFileHealth(f.path, f.compile)
+}
+
+// sdkEvaluator evaluates the policy through the OPA SDK, which manages the
+// bundles, decision logs and status updates of the OPA configuration.
+type sdkEvaluator struct {
+	opa        *sdk.OPA
+	generation *storeGeneration
+	startup    *bundleStartup
+	tracker    *healthTracker
+	compile    compileOptions
+}
+
+func (e sdkEvaluator) Policy(ctx context.Context) (policyVersion, error) {
+
+	if !e.startup.activated() {
+		return e.startup.fallback(ctx, e.compile)
+	}
+	if err := e.tracker.policyError(); err != nil {
+		return policyVersion{}, err
+	}
+
+	return policyVersion{hash: e.generation.String(), eval: e.eval}, nil
+}
+
+func (e sdkEvaluator) eval(ctx context.Context, query string, input interface{}) (decision, error) {
+
+	decisionOptions := sdk.DecisionOptions{
+		Input: input,
+		Path:  normalizeAllowPath(query, true),
+	}
+
+	result, err := e.opa.Decision(ctx, decisionOptions)
+	if err != nil {
+		if sdk.IsUndefinedErr(err) && result != nil {
+			// Decision is undefined. Fallback to deny.
+			return decision{id: result.ID, revision: bundleRevision(result.Provenance)}, nil
+		}
+		return decision{}, err
+	}
+
+	d, err := parseDecision(result.Result)
+	d.id = result.ID
+	d.revision = bundleRevision(result.Provenance)
+	return d, err
+}
+
+func (e sdkEvaluator) Health() Health {
+
+	health := e.tracker.health()
+	if !e.startup.activated() {
+		fb, _ := embeddedFallback()
+		health.Fallback = e.startup.policyFile != "" || fb != nil
+	}
+
+	return health
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+)
+
+const parityPolicy = `package docker.authz
+
+default allow := {"allow": false, "reason": "only reads are allowed"}
+
+allow := {"allow": true} if input.Method == "GET"
+`
+
+// paritySources returns a plugin deciding requests with policy for each
+// source of the policy: a policy file, a bundle archive, a bundle directory
+// and a bundle loaded by the OPA SDK.
+func paritySources(t *testing.T, policy string) map[string]DockerAuthZPlugin {
+	t.Helper()
+	return compiledSources(t, policy, compileOptions{})
+}
+
+// compiledSources returns a plugin deciding requests with policy compiled
+// under c for each source of the policy.
+func compiledSources(t *testing.T, policy string, c compileOptions) map[string]DockerAuthZPlugin {
+	t.Helper()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "policy.rego")
+	if err := os.WriteFile(file, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := filepath.Join(dir, "authz.tar.gz")
+	writeBundleArchive(t, archive, "r1", policy, "", "")
+	bf, err := newBundleFile(archive, "", "", "", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policyDirPath := filepath.Join(dir, "authz")
+	if err := os.Mkdir(policyDirPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writePolicyDir(t, policyDirPath, `{"revision": "r1"}`, policy)
+	pd, err := loadPolicyDir(policyDirPath, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := inmem.New()
+	if err := insertLib(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	tracker := newHealthTracker(c)
+	opa, err := initOPA(ctx, writeBundleConfig(t, dir, "bundle", "r1", policy), nil, store, nil, tracker.managerOption(), c.managerOption())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	t.Cleanup(func() { opa.Stop(ctx) })
+
+	base := DockerAuthZPlugin{
+		allowPath:   "data.docker.authz.allow",
+		instanceID:  "test-instance",
+		quiet:       true,
+		mode:        modeEnforce,
+		failureMode: failClosed,
+		compile:     c,
+	}
+
+	sources := map[string]DockerAuthZPlugin{}
+	for _, name := range []string{"file", "bundle", "dir", "sdk"} {
+		p := base
+		switch name {
+		case "file":
+			p.policyFile = file
+		case "bundle":
+			p.bundleFile = bf
+		case "dir":
+			p.policyDir = pd
+		case "sdk":
+			p.configFile = "config.yaml"
+			p.policyHealth = tracker
+			p.opa = opa
+		}
+		sources[name] = p
+	}
+
+	return sources
+}
+
+func TestEvaluatorParity(t *testing.T) {
+	get := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+	post := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}
+
+	for name, plugin := range paritySources(t, parityPolicy) {
+		t.Run(name, func(t *testing.T) {
+			if response := plugin.AuthZReq(get); !response.Allow {
+				t.Errorf("Expected GET to be allowed, got %+v", response)
+			}
+
+			response := plugin.AuthZReq(post)
+			if response.Allow || response.Err != "" || !strings.HasPrefix(response.Msg, "only reads are allowed [policy ") {
+				t.Errorf("Expected POST to be denied with the policy reason, got %+v", response)
+			}
+
+			if h := plugin.health(); !h.Ready || h.Revision == "" {
+				t.Errorf("Expected ready policy, got %+v", h)
+			}
+
+			plugin.allowPath = "data.docker.authz.missing"
+			d, err := plugin.decide(context.Background(), get)
+			if err != nil || d.allow {
+				t.Errorf("Expected undefined decision to deny without error, got %+v (error: %v)", d, err)
+			}
+		})
+	}
+}
+
+func TestEvaluatorParityLogging(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	post := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}
+
+	for name, plugin := range paritySources(t, parityPolicy) {
+		t.Run(name, func(t *testing.T) {
+			buf.Reset()
+			plugin.quiet = false
+			plugin.logOnlyDenied = true
+			plugin.mode = modeAudit
+
+			if response := plugin.AuthZReq(post); !response.Allow {
+				t.Errorf("Expected request to be allowed in audit mode, got %+v", response)
+			}
+
+			out := buf.String()
+			for _, field := range []string{`"decision_id":`, `"config_hash":`, `"revision":"`, `"reason":"only reads are allowed"`, `"shadow":true`} {
+				if !strings.Contains(out, field) {
+					t.Errorf("Expected decision log with %s, got %q", field, out)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluatorParityCache(t *testing.T) {
+	get := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+
+	for name, plugin := range paritySources(t, parityPolicy) {
+		t.Run(name, func(t *testing.T) {
+			rules, err := parseCacheRules("GET:/containers/json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			plugin.cache = newDecisionCache(10, time.Minute, rules)
+			hits := counterValue(t, cacheLookupsTotal.WithLabelValues("hit"))
+
+			for i := 0; i < 2; i++ {
+				if response := plugin.AuthZReq(get); !response.Allow {
+					t.Errorf("Expected GET to be allowed, got %+v", response)
+				}
+			}
+
+			if got := counterValue(t, cacheLookupsTotal.WithLabelValues("hit")) - hits; got != 1 {
+				t.Errorf("Expected one cache hit, got %v", got)
+			}
+		})
+	}
+}
+
+func TestEvaluatorParityTimeout(t *testing.T) {
+	slow, err := os.ReadFile("testdata/slow.rego")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}
+
+	for name, plugin := range paritySources(t, string(slow)) {
+		t.Run(name, func(t *testing.T) {
+			plugin.decisionTimeout = 10 * time.Millisecond
+
+			start := time.Now()
+			response := plugin.AuthZReq(get)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("Expected decision to be cancelled, took %v", elapsed)
+			}
+			if response.Allow || !strings.Contains(response.Err, "timed out") {
+				t.Errorf("Expected timed out decision to fail closed, got %+v", response)
+			}
+		})
+	}
+}
@@ -65,8 +65,11 @@ labels[key] := value if {
 	some key, value in input.Body.Labels
 }
 
-# Create a shorthand rule for user mapping from input
-user := users[input.Headers["Authz-User"]]
+# Create a shorthand rule for user mapping from input. The identity is
+# resolved by the plugin, and by default falls back to the client-supplied
+# Authz-User header. Such identities are not verified, so real policies should
+# also require input.Identity.Verified.
+user := users[input.Identity.Name]
 
 # Example users. A real implementation would likely have users provided
 # as data rather than coded directly into the policy.
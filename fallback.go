@@ -0,0 +1,97 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/open-policy-agent/opa/v1/bundle"
+)
+
+// fallbackFS holds the policy bundle compiled into the binary, which decides
+// requests when no policy is available. It holds no policy unless one was
+// added to the fallback directory before building.
+//
+//go:embed all:fallback
+var fallbackFS embed.FS
+
+// fallbackActive records whether requests were last decided by the embedded
+// fallback policy in policy-file mode, to log when it becomes (in)active.
+var fallbackActive atomic.Bool
+
+// embeddedFallback returns the embedded fallback bundle, or nil if it holds
+// no policy.
+var embeddedFallback = sync.OnceValues(func() (*loadedBundle, error) {
+
+	fb, err := loadFallbackBundle(fallbackFS, "fallback")
+	if err != nil {
+		return nil, err
+	}
+	if len(fb.bundle.Modules) == 0 {
+		return nil, nil
+	}
+
+	return fb, nil
+})
+
+func loadFallbackBundle(fsys fs.FS, root string) (*loadedBundle, error) {
+
+	sub, err := fs.Sub(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+
+	loader, err := bundle.NewFSLoader(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := bundle.NewCustomReader(loader).Read()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFS(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLoadedBundle("embedded", &b, hash), nil
+}
+
+// hashFS returns the SHA-256 hex digest of the names and contents of the
+// files in fsys.
+func hashFS(fsys fs.FS) (string, error) {
+
+	var paths []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			paths = append(paths, path)
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, path := range paths {
+		bs, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return "", err
+		}
+		h.Write([]byte(path))
+		h.Write(bs)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func testFallbackBundle(t *testing.T, manifest string) *loadedBundle {
+	t.Helper()
+
+	fsys := fstest.MapFS{
+		"fallback/README.md":   {Data: []byte("# Fallback\n")},
+		"fallback/policy.rego": {Data: []byte("package docker.authz\n\nallow if input.Method == \"GET\"\n")},
+	}
+	if manifest != "" {
+		fsys["fallback/.manifest"] = &fstest.MapFile{Data: []byte(manifest)}
+	}
+
+	fb, err := loadFallbackBundle(fsys, "fallback")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return fb
+}
+
+func TestLoadFallbackBundle(t *testing.T) {
+	fb := testFallbackBundle(t, `{"revision": "v3"}`)
+	if fb.revision != "embedded@v3" || len(fb.bundle.Modules) != 1 {
+		t.Errorf("Expected bundle with revision embedded@v3, got %s with %d modules", fb.revision, len(fb.bundle.Modules))
+	}
+
+	unversioned := testFallbackBundle(t, "")
+	if unversioned.revision != "embedded@"+policyFileRevision(unversioned.hash) {
+		t.Errorf("Expected revision of the bundle files, got %s", unversioned.revision)
+	}
+	if unversioned.hash == fb.hash {
+		t.Errorf("Expected bundles with different files to have different hashes")
+	}
+
+	ctx := context.Background()
+	for method, expected := range map[string]bool{"GET": true, "POST": false} {
+		d, err := fb.eval(ctx, compileOptions{}, "data.docker.authz.allow", map[string]interface{}{"Method": method})
+		if err != nil || d.allow != expected {
+			t.Errorf("Expected %s to be allowed: %v, got %v (%v)", method, expected, d.allow, err)
+		}
+	}
+}
+
+func TestEmbeddedFallbackIsEmpty(t *testing.T) {
+	fb, err := embeddedFallback()
+	if err != nil || fb != nil {
+		t.Errorf("Expected no embedded fallback policy, got %v (%v)", fb, err)
+	}
+}
+
+func TestAuthZReqEmbeddedFallback(t *testing.T) {
+	fb := testFallbackBundle(t, `{"revision": "v3"}`)
+	defer func(f func() (*loadedBundle, error)) { embeddedFallback = f }(embeddedFallback)
+	embeddedFallback = func() (*loadedBundle, error) { return fb, nil }
+
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/nonexistent.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		mode:       modeEnforce,
+	}
+
+	if response := plugin.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}); !response.Allow {
+		t.Errorf("Expected GET to be allowed by the fallback policy, got %+v", response)
+	}
+
+	response := plugin.AuthZReq(authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"})
+	if response.Allow || response.Msg != defaultDenyMessage+" [policy embedded@v3]" {
+		t.Errorf("Expected POST to be denied by the fallback policy, got %+v", response)
+	}
+
+	if h := policyFileHealth(plugin.policyFile, compileOptions{}); !h.Ready || !h.Fallback || h.Revision != "embedded@v3" {
+		t.Errorf("Expected fallback policy to be reported ready, got %+v", h)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/bundle"
+	"github.com/open-policy-agent/opa/v1/plugins"
+	bundleplugin "github.com/open-policy-agent/opa/v1/plugins/bundle"
+	"github.com/open-policy-agent/opa/v1/server/types"
+	"github.com/open-policy-agent/opa/v1/storage"
+)
+
+// Health is the state of the policy, reported by the /health and /ready
+// management endpoints.
+type Health struct {
+	Ready      bool                    `json:"ready"`
+	Fallback   bool                    `json:"fallback,omitempty"`
+	Revision   string                  `json:"revision,omitempty"`
+	LastReload *time.Time              `json:"last_reload,omitempty"`
+	LastError  string                  `json:"last_error,omitempty"`
+	Plugins    map[string]string       `json:"plugins,omitempty"`
+	Bundles    map[string]BundleHealth `json:"bundles,omitempty"`
+}
+
+// BundleHealth is the activation status of a bundle in config-file mode.
+type BundleHealth struct {
+	Revision       string     `json:"revision,omitempty"`
+	LastActivation *time.Time `json:"last_activation,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+}
+
+// healthTracker follows the plugins and bundles of the OPA instance used in
+// config-file mode, so their state can be reported while bundles are still
+// being downloaded.
+type healthTracker struct {
+	mtx        sync.Mutex
+	plugins    map[string]*plugins.Status
+	bundles    map[string]BundleHealth
+	lastReload time.Time
+	lastError  string
+	listening  bool
+
+	// compile restricts the compilation of activated policies, which are
+	// refused while compileErr is set.
+	compile    compileOptions
+	compileErr error
+}
+
+func newHealthTracker(compile compileOptions) *healthTracker {
+	return &healthTracker{
+		plugins: map[string]*plugins.Status{},
+		bundles: map[string]BundleHealth{},
+		compile: compile,
+	}
+}
+
+// managerOption registers the tracker with the plugin manager of an OPA
+// instance before its plugins are started.
+func (h *healthTracker) managerOption() func(*plugins.Manager) {
+	return func(m *plugins.Manager) {
+		m.RegisterPluginStatusListener("opa-docker-authz", func(status map[string]*plugins.Status) {
+			h.pluginStatus(m, status)
+		})
+		m.RegisterCompilerTrigger(func(txn storage.Transaction) {
+			h.reloaded(m.Store, txn)
+			h.recompile(m, txn)
+		})
+	}
+}
+
+func (h *healthTracker) pluginStatus(m *plugins.Manager, status map[string]*plugins.Status) {
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.plugins = status
+	for name, s := range status {
+		if s != nil && s.State == plugins.StateErr && s.Message != "" {
+			h.lastError = fmt.Sprintf("%s: %s", name, s.Message)
+		}
+	}
+
+	// The bundle plugin is only registered once the configuration has been
+	// processed, so its status updates are subscribed to on the first plugin
+	// status update following its registration. The bundle plugin may hold
+	// its lock while updating its status, hence the goroutine.
+	if h.listening {
+		return
+	}
+	if bp := bundleplugin.Lookup(m); bp != nil {
+		h.listening = true
+		go bp.RegisterBulkListener("opa-docker-authz", h.bundleStatus)
+	}
+}
+
+func (h *healthTracker) bundleStatus(status map[string]*bundleplugin.Status) {
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for name, s := range status {
+		b := h.bundles[name]
+		b.LastError = ""
+		if len(s.Errors) > 0 {
+			b.LastError = s.Errors[0].Error()
+		} else if s.Message != "" {
+			b.LastError = s.Message
+		}
+		if b.LastError != "" {
+			h.lastError = fmt.Sprintf("bundle %s: %s", name, b.LastError)
+		}
+		if !s.LastSuccessfulActivation.IsZero() {
+			activation := s.LastSuccessfulActivation
+			b.Revision = s.ActiveRevision
+			b.LastActivation = &activation
+		}
+		h.bundles[name] = b
+	}
+}
+
+// reloaded records the activation of bundles, along with their revisions.
+// The compilation of the empty store on startup is not a reload.
+func (h *healthTracker) reloaded(store storage.Store, txn storage.Transaction) {
+
+	now := time.Now().UTC()
+
+	ctx := context.Background()
+	names, _ := bundle.ReadBundleNamesFromStore(ctx, store, txn)
+	if len(names) == 0 {
+		return
+	}
+
+	revisions := map[string]string{}
+	for _, name := range names {
+		revisions[name], _ = bundle.ReadBundleRevisionFromStore(ctx, store, txn, name)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.lastReload = now
+	for name, revision := range revisions {
+		b := h.bundles[name]
+		b.Revision = revision
+		if b.LastActivation == nil || b.LastActivation.Before(now) {
+			b.LastActivation = &now
+		}
+		h.bundles[name] = b
+	}
+}
+
+// recompile checks the activated policies against the compile options, if
+// they restrict compilation.
+func (h *healthTracker) recompile(m *plugins.Manager, txn storage.Transaction) {
+
+	if !h.compile.restricted() {
+		return
+	}
+
+	err := h.compile.recompile(context.Background(), m.Store, txn, m.GetCompiler())
+	if err != nil {
+		log.Printf("Refusing activated policies that do not compile with the capabilities and strict mode: %v", err)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.compileErr = err
+}
+
+// policyError returns the error compiling the activated policies, if any.
+func (h *healthTracker) policyError() error {
+
+	if h == nil {
+		return nil
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return h.compileErr
+}
+
+// health reports the policy as ready once every OPA plugin, including the
+// bundle plugin after activating all bundles, reports being ready.
+func (h *healthTracker) health() Health {
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	health := Health{
+		Ready:     len(h.plugins) > 0,
+		LastError: h.lastError,
+		Plugins:   map[string]string{},
+		Bundles:   map[string]BundleHealth{},
+	}
+
+	for name, s := range h.plugins {
+		state := plugins.StateNotReady
+		if s != nil {
+			state = s.State
+		}
+		health.Plugins[name] = string(state)
+		if state != plugins.StateOK {
+			health.Ready = false
+		}
+	}
+
+	provenance := types.ProvenanceV1{Bundles: map[string]types.ProvenanceBundleV1{}}
+	for name, b := range h.bundles {
+		health.Bundles[name] = b
+		if b.LastActivation == nil {
+			health.Ready = false
+		} else {
+			provenance.Bundles[name] = types.ProvenanceBundleV1{Revision: b.Revision}
+		}
+	}
+	health.Revision = bundleRevision(provenance)
+
+	if !h.lastReload.IsZero() {
+		reload := h.lastReload
+		health.LastReload = &reload
+	}
+
+	if h.compileErr != nil {
+		health.Ready = false
+		health.LastError = h.compileErr.Error()
+	}
+
+	return health
+}
+
+// policyFileHealth reports the policy as ready if the policy file can be
+// read and compiled, or if it does not exist but the embedded fallback policy
+// decides requests instead. The policy file is read on every request, so its
+// modification time is reported as the time of the last reload.
+func policyFileHealth(path string, c compileOptions) Health {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		msg := err.Error()
+		if path == "" {
+			msg = "no policy file or config file configured"
+		}
+		if fb, _ := embeddedFallback(); fb != nil && os.IsNotExist(err) {
+			return Health{Ready: true, Fallback: true, Revision: fb.revision, LastError: msg}
+		}
+		return Health{LastError: msg}
+	}
+	modified := info.ModTime().UTC()
+
+	health := Health{LastReload: &modified}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		health.LastError = err.Error()
+		return health
+	}
+
+	hash := sha256.Sum256(bs)
+	health.Revision = policyFileRevision(hex.EncodeToString(hash[:]))
+
+	module, err := ast.ParseModuleWithOpts(path, string(bs), c.parserOptions())
+	if err == nil {
+		err = c.compile(map[string]*ast.Module{path: module})
+	}
+	if err != nil {
+		health.LastError = err.Error()
+		return health
+	}
+
+	health.Ready = true
+	return health
+}
+
+// health reports the state of the policy used by the plugin.
+func (p DockerAuthZPlugin) health() Health {
+	return p.evaluator().Health()
+}
+
+// registerHealthHandlers serves the health of the plugin on /health, which
+// always succeeds while the plugin is running, and on /ready, which fails
+// with 503 Service Unavailable until the policy is ready.
+func registerHealthHandlers(mux *http.ServeMux, p DockerAuthZPlugin) {
+
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, p.health())
+	})
+
+	mux.HandleFunc("GET /ready", func(w http.ResponseWriter, _ *http.Request) {
+		health := p.health()
+		status := http.StatusOK
+		if !health.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, health)
+	})
+}
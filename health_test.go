@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+)
+
+func TestPolicyFileHealth(t *testing.T) {
+	dir := t.TempDir()
+
+	policy := filepath.Join(dir, "policy.rego")
+	if err := os.WriteFile(policy, []byte("package docker.authz\n\nallow := true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.rego")
+	if err := os.WriteFile(invalid, []byte("package docker.authz\n\nallow := undefined_ref\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := policyFileHealth(policy, compileOptions{})
+	if !h.Ready || !strings.HasPrefix(h.Revision, "sha256:") || h.LastReload == nil || h.LastError != "" {
+		t.Errorf("Expected ready policy, got %+v", h)
+	}
+
+	h = policyFileHealth(invalid, compileOptions{})
+	if h.Ready || h.LastError == "" || h.Revision == "" {
+		t.Errorf("Expected invalid policy not to be ready, got %+v", h)
+	}
+
+	h = policyFileHealth(filepath.Join(dir, "missing.rego"), compileOptions{})
+	if h.Ready || h.LastError == "" {
+		t.Errorf("Expected missing policy not to be ready, got %+v", h)
+	}
+}
+
+func TestHealthHandlers(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.rego")
+
+	mux := http.NewServeMux()
+	registerHealthHandlers(mux, DockerAuthZPlugin{policyFile: policy})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string) (int, Health) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var h Health
+		if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, h
+	}
+
+	if status, h := get("/health"); status != http.StatusOK || h.Ready {
+		t.Errorf("Expected healthy but not ready plugin, got %d %+v", status, h)
+	}
+	if status, _ := get("/ready"); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without policy, got %d", status)
+	}
+
+	if err := os.WriteFile(policy, []byte("package docker.authz\n\nallow := true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if status, h := get("/ready"); status != http.StatusOK || !h.Ready {
+		t.Errorf("Expected ready plugin, got %d %+v", status, h)
+	}
+}
+
+// writeBundleConfig writes a bundle directory holding policy under the
+// docker/authz root to dir, and returns the path of an OPA configuration
+// loading it from resource.
+func writeBundleConfig(t *testing.T, dir, resource, revision, policy string) string {
+	t.Helper()
+
+	bundleDir := filepath.Join(dir, "bundle")
+	if err := os.MkdirAll(bundleDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, ".manifest"), []byte(`{"revision": "`+revision+`", "roots": ["docker/authz"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bundleDir, "policy.rego"), []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(dir, "config-"+resource+".yaml")
+	bs := "bundles:\n  authz:\n    resource: file://" + filepath.Join(dir, resource) + "\n"
+	if err := os.WriteFile(config, []byte(bs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func TestHealthTrackerBundles(t *testing.T) {
+	dir := t.TempDir()
+	policy := "package docker.authz\n\nallow := true\n"
+
+	ctx := context.Background()
+
+	tracker := newHealthTracker(compileOptions{})
+	opa, err := initOPA(ctx, writeBundleConfig(t, dir, "bundle", "r1", policy), nil, inmem.New(), nil, tracker.managerOption())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer opa.Stop(ctx)
+
+	h := tracker.health()
+	if !h.Ready || h.Revision != "authz@r1" || h.LastReload == nil || h.Plugins["bundle"] != "OK" {
+		t.Errorf("Expected activated bundle, got %+v", h)
+	}
+
+	missing := newHealthTracker(compileOptions{})
+	timeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	opa, err = initOPA(timeout, writeBundleConfig(t, dir, "missing", "r1", policy), nil, inmem.New(), nil, missing.managerOption())
+	if err == nil {
+		t.Fatalf("Expected startup to time out without bundle")
+	}
+	defer opa.Stop(ctx)
+
+	h = missing.health()
+	if h.Ready || h.Revision != "" || h.LastReload != nil || h.Plugins["bundle"] != "NOT_READY" {
+		t.Errorf("Expected bundle not to be ready, got %+v", h)
+	}
+}
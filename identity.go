@@ -0,0 +1,276 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/util"
+)
+
+// Identity sources, in the order they are consulted by default.
+const (
+	identitySourcePeer        = "peercred"
+	identitySourceDaemon      = "daemon"
+	identitySourceCertificate = "certificate"
+	identitySourceJWT         = "jwt"
+	identitySourceHeader      = "header"
+)
+
+const defaultIdentitySources = identitySourcePeer + "," + identitySourceDaemon + "," + identitySourceCertificate + "," + identitySourceHeader
+
+// Identity is the principal making a request, exposed to policy as
+// input.Identity. Verified is only true if the principal was authenticated
+// by the Docker daemon or by the plugin, rather than claimed by the client.
+type Identity struct {
+	Name     string
+	Source   string
+	Verified bool
+	Groups   []string
+	Claims   map[string]interface{} `json:",omitempty"`
+	Peer     *PeerCredentials       `json:",omitempty"`
+}
+
+// PeerCredentials identify the local process connected to the proxy socket
+// of the plugin.
+type PeerCredentials struct {
+	UID int
+	GID int
+	PID int
+}
+
+type peerContextKey struct{}
+
+// withPeer returns a context carrying the credentials of the connected peer,
+// consulted by the peercred identity source.
+func withPeer(ctx context.Context, peer *PeerCredentials) context.Context {
+	return context.WithValue(ctx, peerContextKey{}, peer)
+}
+
+// identityConfig configures how identities are resolved.
+type identityConfig struct {
+	// sources is a comma separated list of the identity sources to consult,
+	// in order. The first source yielding a principal wins.
+	sources string
+
+	// header is the request header holding the unverified principal name of
+	// the header source.
+	header string
+
+	// jwtHeader is the request header holding the token of the jwt source,
+	// optionally prefixed with "Bearer ".
+	jwtHeader   string
+	jwtClaim    string
+	jwksFile    string
+	jwtIssuer   string
+	jwtAudience string
+
+	// directoryFile is a YAML or JSON file mapping principal names to their
+	// groups, e.g. {"users": {"alice": {"groups": ["admins"]}}}.
+	directoryFile string
+}
+
+type identityDirectory struct {
+	Users map[string]struct {
+		Groups []string `json:"groups"`
+	} `json:"users"`
+}
+
+// identityResolver resolves the Identity of requests. A nil
+// *identityResolver resolves identities from the default sources.
+type identityResolver struct {
+	sources   []string
+	header    string
+	jwtHeader string
+	jwtClaim  string
+	verifier  *jwtVerifier
+	groups    map[string][]string
+}
+
+var defaultIdentityResolver = &identityResolver{
+	sources: []string{identitySourcePeer, identitySourceDaemon, identitySourceCertificate, identitySourceHeader},
+	header:  "Authz-User",
+}
+
+func newIdentityResolver(ctx context.Context, c identityConfig) (*identityResolver, error) {
+
+	ir := &identityResolver{
+		header:    c.header,
+		jwtHeader: c.jwtHeader,
+		jwtClaim:  c.jwtClaim,
+		groups:    map[string][]string{},
+	}
+
+	for _, source := range strings.Split(c.sources, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case "":
+			continue
+		case identitySourcePeer, identitySourceDaemon, identitySourceCertificate, identitySourceHeader:
+		case identitySourceJWT:
+			if c.jwksFile == "" {
+				return nil, fmt.Errorf("identity source %s requires a JWKS file", source)
+			}
+		default:
+			return nil, fmt.Errorf("invalid identity source %q", source)
+		}
+		ir.sources = append(ir.sources, source)
+	}
+
+	if c.jwksFile != "" {
+		jwks, err := os.ReadFile(c.jwksFile)
+		if err != nil {
+			return nil, err
+		}
+
+		ir.verifier, err = newJWTVerifier(ctx, string(jwks), c.jwtIssuer, c.jwtAudience)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.directoryFile != "" {
+		bs, err := os.ReadFile(c.directoryFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var directory identityDirectory
+		if err := util.Unmarshal(bs, &directory); err != nil {
+			return nil, fmt.Errorf("invalid identity directory %s: %w", c.directoryFile, err)
+		}
+		for name, user := range directory.Users {
+			ir.groups[name] = user.Groups
+		}
+	}
+
+	return ir, nil
+}
+
+// resolve returns the identity of the principal making the request, using
+// the first configured source that yields one. The identity is anonymous and
+// unverified if no source does.
+func (ir *identityResolver) resolve(ctx context.Context, r authorization.Request) Identity {
+
+	if ir == nil {
+		ir = defaultIdentityResolver
+	}
+
+	identity := Identity{}
+
+	for _, source := range ir.sources {
+		var ok bool
+		switch source {
+		case identitySourcePeer:
+			identity, ok = resolvePeer(ctx)
+		case identitySourceDaemon:
+			identity, ok = Identity{Name: r.User, Verified: true}, r.User != ""
+		case identitySourceCertificate:
+			if len(r.RequestPeerCertificates) > 0 {
+				name := r.RequestPeerCertificates[0].Subject.CommonName
+				identity, ok = Identity{Name: name, Verified: true}, name != ""
+			}
+		case identitySourceJWT:
+			identity, ok = ir.resolveJWT(ctx, r)
+		case identitySourceHeader:
+			name := requestHeader(r, ir.header)
+			identity, ok = Identity{Name: name}, name != ""
+		}
+		if ok {
+			identity.Source = source
+			break
+		}
+		identity = Identity{}
+	}
+
+	if identity.Name != "" {
+		identity.Groups = append(identity.Groups, ir.groups[identity.Name]...)
+	}
+	if identity.Groups == nil {
+		identity.Groups = []string{}
+	}
+
+	return identity
+}
+
+// resolvePeer maps the credentials of the process connected to the proxy
+// socket, if any, to its user and group names.
+func resolvePeer(ctx context.Context) (Identity, bool) {
+
+	peer, ok := ctx.Value(peerContextKey{}).(*PeerCredentials)
+	if !ok || peer == nil {
+		return Identity{}, false
+	}
+
+	identity := Identity{Name: strconv.Itoa(peer.UID), Verified: true, Groups: []string{}, Peer: peer}
+
+	u, err := user.LookupId(strconv.Itoa(peer.UID))
+	if err == nil {
+		identity.Name = u.Username
+	}
+
+	gids := []string{strconv.Itoa(peer.GID)}
+	if u != nil {
+		if ids, err := u.GroupIds(); err == nil {
+			gids = append(gids, ids...)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, gid := range gids {
+		if seen[gid] {
+			continue
+		}
+		seen[gid] = true
+		if g, err := user.LookupGroupId(gid); err == nil {
+			identity.Groups = append(identity.Groups, g.Name)
+		}
+	}
+
+	return identity, true
+}
+
+// resolveJWT verifies the token in the configured header against the JWKS,
+// returning the principal named by the configured claim.
+func (ir *identityResolver) resolveJWT(ctx context.Context, r authorization.Request) (Identity, bool) {
+
+	if ir.verifier == nil {
+		return Identity{}, false
+	}
+
+	claims, ok := ir.verifier.verify(ctx, bearerToken(requestHeader(r, ir.jwtHeader)))
+	if !ok {
+		return Identity{}, false
+	}
+
+	name, ok := claims[ir.jwtClaim].(string)
+	if !ok || name == "" {
+		return Identity{}, false
+	}
+
+	return Identity{Name: name, Verified: true, Claims: claims}, true
+}
+
+// requestHeader returns the value of the named request header, matching the
+// name case-insensitively.
+func requestHeader(r authorization.Request, name string) string {
+
+	if v, ok := r.RequestHeaders[name]; ok {
+		return v
+	}
+	for k, v := range r.RequestHeaders {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+
+	return ""
+}
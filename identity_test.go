@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// signJWT returns a compact ES256 JWT with the given claims.
+func signJWT(t *testing.T, key *ecdsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	token, err := signES256(key, "test", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// writeJWKS writes a JWKS holding the public key of key, returning its path.
+func writeJWKS(t *testing.T, dir string, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	coord := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32)))
+	}
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC", "crv": "P-256", "kid": "test", "alg": "ES256", "use": "sig",
+			"x": coord(key.PublicKey.X), "y": coord(key.PublicKey.Y),
+		}},
+	})
+	path := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIdentityResolver(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directoryFile := filepath.Join(dir, "directory.yaml")
+	directory := "users:\n  alice:\n    groups: [admins, developers]\n  carol:\n    groups: [developers]\n"
+	if err := os.WriteFile(directoryFile, []byte(directory), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	certFile, _ := ca.issue(t, dir, "carol", x509.ExtKeyUsageClientAuth)
+	certPEM, _ := os.ReadFile(certFile)
+	block, _ := pem.Decode(certPEM)
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := authorization.PeerCertificate(*parsed)
+
+	resolver, err := newIdentityResolver(ctx, identityConfig{
+		sources:       "daemon,certificate,jwt,header",
+		header:        "Authz-User",
+		jwtHeader:     "Authorization",
+		jwtClaim:      "sub",
+		jwksFile:      writeJWKS(t, dir, key),
+		jwtIssuer:     "https://issuer.example.com",
+		directoryFile: directoryFile,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	validToken := signJWT(t, key, map[string]interface{}{"sub": "alice", "iss": "https://issuer.example.com", "exp": exp})
+	expiredToken := signJWT(t, key, map[string]interface{}{"sub": "alice", "iss": "https://issuer.example.com", "exp": float64(1)})
+	foreignToken := signJWT(t, otherKey, map[string]interface{}{"sub": "alice", "iss": "https://issuer.example.com", "exp": exp})
+	wrongIssuerToken := signJWT(t, key, map[string]interface{}{"sub": "alice", "iss": "https://other.example.com", "exp": exp})
+
+	tests := []struct {
+		name     string
+		request  authorization.Request
+		expected Identity
+	}{
+		{
+			name:     "daemon user",
+			request:  authorization.Request{User: "bob", RequestHeaders: map[string]string{"Authz-User": "alice"}},
+			expected: Identity{Name: "bob", Source: identitySourceDaemon, Verified: true, Groups: []string{}},
+		},
+		{
+			name:     "certificate subject",
+			request:  authorization.Request{RequestPeerCertificates: []*authorization.PeerCertificate{&cert}},
+			expected: Identity{Name: "carol", Source: identitySourceCertificate, Verified: true, Groups: []string{"developers"}},
+		},
+		{
+			name:    "verified token",
+			request: authorization.Request{RequestHeaders: map[string]string{"Authorization": "Bearer " + validToken, "Authz-User": "bob"}},
+			expected: Identity{
+				Name: "alice", Source: identitySourceJWT, Verified: true, Groups: []string{"admins", "developers"},
+				Claims: map[string]interface{}{"sub": "alice", "iss": "https://issuer.example.com"},
+			},
+		},
+		{
+			name:     "expired token falls back to header",
+			request:  authorization.Request{RequestHeaders: map[string]string{"authorization": expiredToken, "Authz-User": "bob"}},
+			expected: Identity{Name: "bob", Source: identitySourceHeader, Verified: false, Groups: []string{}},
+		},
+		{
+			name:     "token signed by unknown key",
+			request:  authorization.Request{RequestHeaders: map[string]string{"Authorization": "Bearer " + foreignToken}},
+			expected: Identity{Groups: []string{}},
+		},
+		{
+			name:     "token from wrong issuer",
+			request:  authorization.Request{RequestHeaders: map[string]string{"Authorization": "Bearer " + wrongIssuerToken}},
+			expected: Identity{Groups: []string{}},
+		},
+		{
+			name:     "unverified header",
+			request:  authorization.Request{RequestHeaders: map[string]string{"Authz-User": "alice"}},
+			expected: Identity{Name: "alice", Source: identitySourceHeader, Verified: false, Groups: []string{"admins", "developers"}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := resolver.resolve(ctx, tc.request)
+			for claim, value := range tc.expected.Claims {
+				if result.Claims[claim] != value {
+					t.Errorf("Expected claim %s to be %v, got %v", claim, value, result.Claims[claim])
+				}
+			}
+			result.Claims, tc.expected.Claims = nil, nil
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestNewIdentityResolverErrors(t *testing.T) {
+	for _, sources := range []string{"daemon,unknown", "jwt"} {
+		if _, err := newIdentityResolver(context.Background(), identityConfig{sources: sources}); err == nil {
+			t.Errorf("Expected error for sources %q", sources)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// jwtVerifier verifies signed JWTs using the io.jwt.decode_verify built-in.
+type jwtVerifier struct {
+	constraints map[string]interface{}
+	query       rego.PreparedEvalQuery
+}
+
+// newJWTVerifier returns a verifier accepting tokens signed by one of keys,
+// a PEM encoded certificate or public key, or a JWKS. The issuer and audience
+// are required of tokens if not empty.
+func newJWTVerifier(ctx context.Context, keys, issuer, audience string) (*jwtVerifier, error) {
+
+	v := &jwtVerifier{constraints: map[string]interface{}{"cert": keys}}
+	if issuer != "" {
+		v.constraints["iss"] = issuer
+	}
+	if audience != "" {
+		v.constraints["aud"] = audience
+	}
+
+	query, err := rego.New(rego.Query("io.jwt.decode_verify(input.token, input.constraints)")).PrepareForEval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.query = query
+
+	return v, nil
+}
+
+// verify returns the claims of a token if it is validly signed, current and
+// meets the constraints of the verifier.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (map[string]interface{}, bool) {
+
+	if token == "" {
+		return nil, false
+	}
+
+	rs, err := v.query.Eval(ctx, rego.EvalInput(map[string]interface{}{
+		"token":       token,
+		"constraints": v.constraints,
+	}))
+	if err != nil || len(rs) == 0 {
+		return nil, false
+	}
+
+	result, ok := rs[0].Expressions[0].Value.([]interface{})
+	if !ok || len(result) != 3 || result[0] != true {
+		return nil, false
+	}
+
+	claims, ok := result[2].(map[string]interface{})
+	return claims, ok
+}
+
+// bearerToken strips the optional "Bearer " prefix from a header value.
+func bearerToken(value string) string {
+	if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+		return value[7:]
+	}
+	return value
+}
+
+// signES256 returns a compact ES256 JWT with the given claims, carrying the
+// key ID kid in its header if not empty.
+func signES256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) (string, error) {
+
+	if key.Curve != elliptic.P256() {
+		return "", fmt.Errorf("ES256 requires a P-256 key")
+	}
+
+	header := map[string]string{"alg": "ES256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	hbs, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	cbs, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(hbs) + "." + base64.RawURLEncoding.EncodeToString(cbs)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"log"
+	"strconv"
+	"sync"
+
+	version_pkg "github.com/open-policy-agent/opa-docker-authz/version"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/plugins"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/storage"
+)
+
+// libFS holds the Rego library shipped with the plugin, defining helpers in
+// the docker.lib package for use by policies.
+//
+//go:embed lib/*.rego
+var libFS embed.FS
+
+// libModulePrefix prefixes the names of the library modules, keeping them
+// apart from the modules of policies.
+const libModulePrefix = "opa-docker-authz/"
+
+// libSources returns the modules of the library, keyed by name, including a
+// module defining the version of the plugin shipping it.
+var libSources = sync.OnceValues(func() (map[string]string, error) {
+
+	sources := map[string]string{
+		libModulePrefix + "lib/version.rego": "package docker.lib\n\nimport rego.v1\n\nversion := " + strconv.Quote(version_pkg.Version) + "\n",
+	}
+
+	files, err := fs.Glob(libFS, "lib/*.rego")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		bs, err := libFS.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sources[libModulePrefix+file] = string(bs)
+	}
+
+	return sources, nil
+})
+
+// libModules returns the parsed modules of the library, keyed by name.
+var libModules = sync.OnceValues(func() (map[string]*ast.Module, error) {
+
+	sources, err := libSources()
+	if err != nil {
+		return nil, err
+	}
+
+	modules := make(map[string]*ast.Module, len(sources))
+	for name, src := range sources {
+		module, err := ast.ParseModuleWithOpts(name, src, ast.ParserOptions{ProcessAnnotation: true})
+		if err != nil {
+			return nil, err
+		}
+		modules[name] = module
+	}
+
+	return modules, nil
+})
+
+// libOptions returns the options loading the library alongside a policy
+// evaluated in-process.
+func libOptions() []func(*rego.Rego) {
+
+	modules, _ := libModules()
+
+	options := make([]func(*rego.Rego), 0, len(modules))
+	for _, module := range modules {
+		options = append(options, rego.ParsedModule(module))
+	}
+
+	return options
+}
+
+// withLib adds the library to the modules of a policy to compile.
+func withLib(modules map[string]*ast.Module) map[string]*ast.Module {
+
+	lib, _ := libModules()
+	for name, module := range lib {
+		modules[name] = module
+	}
+
+	return modules
+}
+
+// insertLib writes the library to the store of the OPA SDK in config-file
+// mode. Bundles whose roots include docker/lib replace it when they are
+// activated.
+func insertLib(ctx context.Context, store storage.Store) error {
+
+	sources, err := libSources()
+	if err != nil {
+		return err
+	}
+
+	return storage.Txn(ctx, store, storage.WriteParams, func(txn storage.Transaction) error {
+		for name, src := range sources {
+			if err := store.UpsertPolicy(ctx, txn, name, []byte(src)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// libManagerOption returns an option for the OPA plugin manager logging when
+// activated bundles replaced the library.
+func libManagerOption() func(*plugins.Manager) {
+
+	var warned sync.Once
+
+	return func(m *plugins.Manager) {
+		m.RegisterCompilerTrigger(func(txn storage.Transaction) {
+			sources, _ := libSources()
+			for name := range sources {
+				if _, err := m.Store.GetPolicy(context.Background(), txn, name); err != nil {
+					warned.Do(func() {
+						log.Printf("The docker.lib Rego library was removed by a bundle whose roots include docker/lib, declare narrower bundle roots to use it.")
+					})
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+# Copyright 2016 The OPA Authors.  All rights reserved.
+# Use of this source code is governed by an Apache2
+# license that can be found in the LICENSE file.
+
+# METADATA
+# description: |
+#   Helpers for Docker authorization policies, shipped with opa-docker-authz
+#   and loaded alongside the policy in every mode. The library is versioned
+#   with the plugin, whose version is data.docker.lib.version.
+package docker.lib
+
+# The library is parsed for the Rego version policies are parsed with, and is
+# written to be valid in either.
+import rego.v1
+
+# METADATA
+# description: |
+#   api_path is the path of the request without its query and API version
+#   prefix, e.g. /containers/create for /v1.47/containers/create?name=web.
+api_path := regex.replace(input.PathPlain, `^/v[0-9]+(\.[0-9]+)?(/|$)`, "/")
+
+# METADATA
+# description: |
+#   request(method, pattern) is true if the request has the given method and
+#   an API path matching the glob pattern, on any API version.
+request(method, pattern) if {
+	input.Method == method
+	glob.match(pattern, ["/"], api_path)
+}
+
+# METADATA
+# description: read_only is true for requests that cannot change any state.
+read_only if input.Method in {"GET", "HEAD"}
+
+container_create if request("POST", "/containers/create")
+
+container_exec if request("POST", "/containers/*/exec")
+
+image_pull if request("POST", "/images/create")
+
+image_build if request("POST", "/build")
+
+# METADATA
+# description: privileged is true for requests creating a privileged container.
+privileged if input.Body.HostConfig.Privileged == true
+
+# METADATA
+# description: |
+#   bind_mounts contains the host paths of the bind mounts of the request,
+#   resolved to their symlink targets where they exist on the host.
+bind_mounts contains mount_path(mount) if some mount in input.BindMounts
+
+# METADATA
+# description: |
+#   writable_bind_mounts contains the host paths of the bind mounts of the
+#   request that are not read-only.
+writable_bind_mounts contains mount_path(mount) if {
+	some mount in input.BindMounts
+	not mount.ReadOnly
+}
+
+mount_path(mount) := mount.Resolved if mount.Resolved != ""
+
+mount_path(mount) := mount.Source if mount.Resolved == ""
+
+# METADATA
+# description: |
+#   bind_mount_under(prefix) is true if any bind mount of the request is the
+#   host path prefix or below it, e.g. bind_mount_under("/etc"), once both are
+#   resolved through symlinks and .. segments.
+bind_mount_under(prefix) if {
+	some mount in input.BindMounts
+	docker.path.under(mount.Source, prefix)
+}
+
+# METADATA
+# description: |
+#   writable_bind_mount_under(prefix) is true if any bind mount of the request
+#   that is not read-only is the host path prefix or below it.
+writable_bind_mount_under(prefix) if {
+	some mount in input.BindMounts
+	not mount.ReadOnly
+	docker.path.under(mount.Source, prefix)
+}
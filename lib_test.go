@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	version_pkg "github.com/open-policy-agent/opa-docker-authz/version"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+)
+
+// evalLib evaluates query against the library for a request.
+func evalLib(t *testing.T, query string, r authorization.Request) interface{} {
+	t.Helper()
+
+	input, err := makeInput(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := rego.New(append(libOptions(), rego.Query(query), rego.Input(input))...).Eval(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rs) == 0 {
+		return nil
+	}
+
+	return rs[0].Expressions[0].Value
+}
+
+func TestLibModules(t *testing.T) {
+	if _, err := libModules(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if got := evalLib(t, "data.docker.lib.version", authorization.Request{}); got != version_pkg.Version {
+		t.Errorf("Expected library version %v, got %v", version_pkg.Version, got)
+	}
+}
+
+func TestLibHelpers(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "config")
+	if err := os.Symlink("/etc", link); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(binds ...string) authorization.Request {
+		body := `{"Image": "busybox", "HostConfig": {"Privileged": true, "Binds": [`
+		for i, bind := range binds {
+			if i > 0 {
+				body += ","
+			}
+			body += `"` + bind + `"`
+		}
+		body += `]}}`
+		return authorization.Request{
+			RequestMethod:  "POST",
+			RequestURI:     "/v1.47/containers/create?name=web",
+			RequestBody:    []byte(body),
+			RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		}
+	}
+
+	tests := []struct {
+		note     string
+		query    string
+		request  authorization.Request
+		expected interface{}
+	}{
+		{"api path", "data.docker.lib.api_path", authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json?all=1"}, "/containers/json"},
+		{"api path without version", "data.docker.lib.api_path", authorization.Request{RequestMethod: "GET", RequestURI: "/_ping"}, "/_ping"},
+		{"read only", "data.docker.lib.read_only", authorization.Request{RequestMethod: "HEAD", RequestURI: "/_ping"}, true},
+		{"not read only", "data.docker.lib.read_only", create(), nil},
+		{"container create", "data.docker.lib.container_create", create(), true},
+		{"container create without version", "data.docker.lib.container_create", authorization.Request{RequestMethod: "POST", RequestURI: "/containers/create"}, true},
+		{"container list", "data.docker.lib.container_create", authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}, nil},
+		{"container exec", "data.docker.lib.container_exec", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/web/exec"}, true},
+		{"image pull", "data.docker.lib.image_pull", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/images/create?fromImage=busybox"}, true},
+		{"image build", "data.docker.lib.image_build", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/build"}, true},
+		{"privileged", "data.docker.lib.privileged", create(), true},
+		{"bind mount under", `data.docker.lib.bind_mount_under("/etc")`, create("/etc/ssl:/ssl:ro"), true},
+		{"bind mount of prefix", `data.docker.lib.bind_mount_under("/etc/")`, create("/etc:/host-etc"), true},
+		{"bind mount beside prefix", `data.docker.lib.bind_mount_under("/etc")`, create("/etcetera:/data"), nil},
+		{"bind mount through symlink", `data.docker.lib.bind_mount_under("/etc")`, create(link + ":/config"), true},
+		{"unresolved bind mount", `data.docker.lib.bind_mount_under("/etc")`, create("/nonexistent/../etc:/config"), true},
+		{"read-only bind mount", `data.docker.lib.writable_bind_mount_under("/etc")`, create("/etc:/config:ro"), nil},
+		{"writable bind mount", `data.docker.lib.writable_bind_mount_under("/etc")`, create("/etc/ssl:/ssl:ro", "/etc:/config"), true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			if got := evalLib(t, tc.query, tc.request); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAuthZReqLib(t *testing.T) {
+	policy := `package docker.authz
+
+import data.docker.lib
+
+default allow := false
+
+allow if lib.read_only
+
+allow if {
+	lib.container_create
+	not lib.bind_mount_under("/etc")
+}
+`
+
+	tests := []struct {
+		note          string
+		request       authorization.Request
+		expectedAllow bool
+	}{
+		{"read only", authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}, true},
+		{"create", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create", RequestBody: []byte(`{"HostConfig": {"Binds": ["/srv:/srv"]}}`), RequestHeaders: map[string]string{"Content-Type": "application/json"}}, true},
+		{"create mounting /etc", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create", RequestBody: []byte(`{"HostConfig": {"Binds": ["/etc:/etc"]}}`), RequestHeaders: map[string]string{"Content-Type": "application/json"}}, false},
+		{"other", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/volumes/create"}, false},
+	}
+
+	for name, plugin := range paritySources(t, policy) {
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range tests {
+				res := plugin.AuthZReq(tc.request)
+				if res.Allow != tc.expectedAllow || res.Err != "" {
+					t.Errorf("%s: expected allow: %v, got %+v", tc.note, tc.expectedAllow, res)
+				}
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(file, []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if code := regoSyntax(file, compileOptions{}); code != 0 {
+		t.Errorf("Expected policy using the library to pass the syntax check, got %d", code)
+	}
+}
+
+func TestInsertLib(t *testing.T) {
+	ctx := context.Background()
+
+	store := inmem.New()
+	if err := insertLib(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := storage.NewTransactionOrDie(ctx, store)
+	defer store.Abort(ctx, txn)
+
+	ids, err := store.ListPolicies(ctx, txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources, _ := libSources()
+	if len(ids) != len(sources) {
+		t.Errorf("Expected %d library modules in the store, got %v", len(sources), ids)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// listenConfig describes where the plugin API is served when the plugin is
+// not simply listening on its socket in the Docker plugin directory.
+type listenConfig struct {
+	pluginName string
+
+	// addr is either unix:///path/to/socket or tcp://host:port.
+	addr string
+
+	// Server certificate, key and the CA used to verify client certificates.
+	// Clients must present a certificate if a CA is given.
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsCACertFile string
+
+	// specDir is the directory the plugin spec file is written to, so the
+	// Docker daemon can discover the plugin. No spec file is written if empty.
+	specDir string
+
+	// Files the Docker daemon uses to connect to the plugin over TLS.
+	specTLSCAFile   string
+	specTLSCertFile string
+	specTLSKeyFile  string
+}
+
+// pluginSpec is the JSON plugin spec understood by the Docker daemon.
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *pluginSpecTLS `json:",omitempty"`
+}
+
+type pluginSpecTLS struct {
+	InsecureSkipVerify bool
+	CAFile             string `json:",omitempty"`
+	CertFile           string `json:",omitempty"`
+	KeyFile            string `json:",omitempty"`
+}
+
+// serve serves the plugin API until the listener fails or ctx is done,
+// writing the plugin spec file for the duration.
+func (c listenConfig) serve(ctx context.Context, h *authorization.Handler) error {
+
+	l, err := c.listen()
+	if err != nil {
+		return err
+	}
+
+	if c.specDir != "" {
+		spec, err := c.writeSpec(l)
+		if err != nil {
+			_ = l.Close()
+			return err
+		}
+		defer os.Remove(spec)
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = l.Close() })
+	defer stop()
+
+	log.Printf("Listening on %s://%s.", l.Addr().Network(), l.Addr().String())
+	err = h.Serve(l)
+	if ctx.Err() != nil {
+		log.Printf("Stopped listening on %s://%s.", l.Addr().Network(), l.Addr().String())
+		return nil
+	}
+
+	return err
+}
+
+// validate rejects TLS settings that would otherwise be ignored, like a CA
+// verifying client certificates on a listener without TLS, and TCP listeners
+// reachable from the network that do not verify client certificates, since
+// anyone reaching them could forge the requests and responses of a daemon.
+func (c listenConfig) validate() error {
+
+	if !c.tls() && (c.tlsKeyFile != "" || c.tlsCACertFile != "") {
+		return fmt.Errorf("the tls-private-key-file and tls-ca-cert-file arguments require tls-cert-file")
+	}
+
+	if u, err := url.Parse(c.addr); err == nil && u.Scheme == "tcp" && c.tlsCACertFile == "" && !loopback(u.Host) {
+		return fmt.Errorf("tcp listeners on other than loopback addresses require tls-cert-file and tls-ca-cert-file")
+	}
+
+	return nil
+}
+
+// loopback reports whether a host:port only listens on a loopback interface.
+func loopback(hostport string) bool {
+
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func (c listenConfig) tls() bool {
+	return c.tlsCertFile != ""
+}
+
+// listen creates the listener described by the configuration.
+func (c listenConfig) listen() (net.Listener, error) {
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if c.tls() {
+			return nil, fmt.Errorf("TLS is only supported on tcp:// listeners")
+		}
+		return listenUnix(u.Path)
+	case "tcp":
+		l, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if c.tlsCACertFile == "" {
+			log.Printf("Warning: clients of %s are not authenticated, so any local process can call the plugin API as the Docker daemon.", c.addr)
+		}
+		if !c.tls() {
+			return l, nil
+		}
+		config, err := c.tlsConfig()
+		if err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		return tls.NewListener(l, config), nil
+	default:
+		return nil, fmt.Errorf("invalid listen address %q, expected unix:///path or tcp://host:port", c.addr)
+	}
+}
+
+func listenUnix(path string) (net.Listener, error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("missing socket path")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	// Only stale sockets are replaced, so a mistyped path cannot delete a file.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0o660); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (c listenConfig) tlsConfig() (*tls.Config, error) {
+
+	cert, err := tls.LoadX509KeyPair(c.tlsCertFile, c.tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.tlsCACertFile != "" {
+		bs, err := os.ReadFile(c.tlsCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no CA certificates found in %s", c.tlsCACertFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// writeSpec writes the plugin spec file for a listener, returning its path.
+// A .spec file holding the address is written for plain listeners, and a
+// .json file including the daemon's TLS settings for TLS listeners.
+func (c listenConfig) writeSpec(l net.Listener) (string, error) {
+
+	if err := os.MkdirAll(c.specDir, 0o755); err != nil {
+		return "", err
+	}
+
+	addr := l.Addr().Network() + "://" + l.Addr().String()
+
+	if !c.tls() {
+		path := filepath.Join(c.specDir, c.pluginName+".spec")
+		return path, os.WriteFile(path, []byte(addr), 0o644)
+	}
+
+	spec := pluginSpec{
+		Name: c.pluginName,
+		Addr: addr,
+		TLSConfig: &pluginSpecTLS{
+			CAFile:   c.specTLSCAFile,
+			CertFile: c.specTLSCertFile,
+			KeyFile:  c.specTLSKeyFile,
+		},
+	}
+	bs, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(c.specDir, c.pluginName+".json")
+	return path, os.WriteFile(path, bs, 0o644)
+}
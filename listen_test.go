@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert, key}
+}
+
+// issue writes a certificate and key for commonName to dir, returning their
+// paths.
+func (ca *testCA) issue(t *testing.T, dir, commonName string, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, commonName+".crt")
+	keyFile := filepath.Join(dir, commonName+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func (ca *testCA) write(t *testing.T, dir string) string {
+	t.Helper()
+	path := filepath.Join(dir, "ca.crt")
+	writePEM(t, path, "CERTIFICATE", ca.cert.Raw)
+	return path
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	bs := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, bs, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func authZReq(t *testing.T, client *http.Client, url string, request authorization.Request) (authorization.Response, error) {
+	t.Helper()
+	bs, _ := json.Marshal(request)
+	resp, err := client.Post(url+"/AuthZPlugin.AuthZReq", "application/json", bytes.NewReader(bs))
+	if err != nil {
+		return authorization.Response{}, err
+	}
+	defer resp.Body.Close()
+
+	var response authorization.Response
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return response, err
+}
+
+func TestListenTCP(t *testing.T) {
+	specDir := t.TempDir()
+	config := listenConfig{pluginName: "authz", addr: "tcp://127.0.0.1:0", specDir: specDir}
+
+	l, err := config.listen()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	spec, err := config.writeSpec(l)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	bs, _ := os.ReadFile(spec)
+	if expected := "tcp://" + l.Addr().String(); string(bs) != expected || filepath.Base(spec) != "authz.spec" {
+		t.Errorf("Expected spec file authz.spec with %s, got %s with %s", expected, spec, bs)
+	}
+
+	plugin := DockerAuthZPlugin{policyFile: "testdata/default_allow.rego", allowPath: "data.docker.authz.allow", quiet: true}
+	go func() { _ = authorization.NewHandler(plugin).Serve(l) }()
+
+	response, err := authZReq(t, http.DefaultClient, "http://"+l.Addr().String(), authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/info"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !response.Allow {
+		t.Errorf("Expected request to be allowed, got %+v", response)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "authz.sock")
+	config := listenConfig{pluginName: "authz", addr: "unix://" + path, specDir: t.TempDir()}
+
+	l, err := config.listen()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	spec, err := config.writeSpec(l)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if bs, _ := os.ReadFile(spec); string(bs) != "unix://"+path {
+		t.Errorf("Expected spec file with unix://%s, got %s", path, bs)
+	}
+}
+
+func TestListenUnixExistingFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "authz.sock")
+	stale, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	l.Close()
+
+	file := filepath.Join(dir, "authz.rego")
+	if err := os.WriteFile(file, []byte("package docker.authz"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := listenUnix(file); err == nil {
+		l.Close()
+		t.Errorf("Expected error listening on a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected regular file to be kept, got %v", err)
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.write(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "daemon", x509.ExtKeyUsageClientAuth)
+
+	config := listenConfig{
+		pluginName:      "authz",
+		addr:            "tcp://127.0.0.1:0",
+		tlsCertFile:     serverCert,
+		tlsKeyFile:      serverKey,
+		tlsCACertFile:   caFile,
+		specDir:         dir,
+		specTLSCAFile:   caFile,
+		specTLSCertFile: clientCert,
+		specTLSKeyFile:  clientKey,
+	}
+
+	l, err := config.listen()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer l.Close()
+
+	specFile, err := config.writeSpec(l)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var spec pluginSpec
+	bs, _ := os.ReadFile(specFile)
+	if err := json.Unmarshal(bs, &spec); err != nil {
+		t.Fatalf("Improper JSON spec - got %v", err)
+	}
+	if spec.Name != "authz" || spec.Addr != "tcp://"+l.Addr().String() || spec.TLSConfig == nil || spec.TLSConfig.CertFile != clientCert {
+		t.Errorf("Unexpected spec %+v", spec)
+	}
+
+	plugin := DockerAuthZPlugin{policyFile: "testdata/default_allow.rego", allowPath: "data.docker.authz.allow", quiet: true}
+	go func() { _ = authorization.NewHandler(plugin).Serve(l) }()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	url := "https://" + l.Addr().String()
+	request := authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/info"}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err := authZReq(t, anonymous, url, request); err == nil {
+		t.Errorf("Expected request without client certificate to fail")
+	}
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+	response, err := authZReq(t, authenticated, url, request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !response.Allow {
+		t.Errorf("Expected request to be allowed, got %+v", response)
+	}
+}
+
+func TestListenInvalidAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:9000", "http://127.0.0.1:9000", "unix://"} {
+		if l, err := (listenConfig{addr: addr}).listen(); err == nil {
+			l.Close()
+			t.Errorf("Expected error for %q", addr)
+		}
+	}
+}
+
+func TestListenTLSSettingsWithoutCert(t *testing.T) {
+	for _, config := range []listenConfig{
+		{addr: "tcp://127.0.0.1:0", tlsCACertFile: "ca.crt"},
+		{addr: "tcp://127.0.0.1:0", tlsKeyFile: "plugin.key"},
+	} {
+		if l, err := config.listen(); err == nil {
+			l.Close()
+			t.Errorf("Expected error for %+v", config)
+		}
+	}
+}
+
+func TestListenTCPWithoutClientTLS(t *testing.T) {
+	for _, addr := range []string{"tcp://0.0.0.0:0", "tcp://:0", "tcp://192.0.2.1:0"} {
+		if err := (listenConfig{addr: addr}).validate(); err == nil {
+			t.Errorf("Expected error for %q", addr)
+		}
+	}
+	for _, addr := range []string{"tcp://127.0.0.1:0", "tcp://[::1]:0", "tcp://localhost:0"} {
+		if err := (listenConfig{addr: addr}).validate(); err != nil {
+			t.Errorf("Unexpected error for %q: %v", addr, err)
+		}
+	}
+}
+
+func TestServeRemovesSpec(t *testing.T) {
+	specDir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "authz.sock")
+	config := listenConfig{pluginName: "authz", addr: "unix://" + path, specDir: specDir}
+	spec := filepath.Join(specDir, "authz.spec")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	plugin := DockerAuthZPlugin{policyFile: "testdata/default_allow.rego", allowPath: "data.docker.authz.allow", quiet: true}
+	go func() { done <- config.serve(ctx, authorization.NewHandler(plugin)) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(spec); err != nil; _, err = os.Stat(spec) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected spec file to be written: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected serve to stop")
+	}
+	if _, err := os.Stat(spec); !os.IsNotExist(err) {
+		t.Errorf("Expected spec file to be removed, got %v", err)
+	}
+}
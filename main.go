@@ -5,175 +5,390 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/authorization"
 	version_pkg "github.com/open-policy-agent/opa-docker-authz/version"
 	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/bundle"
 	"github.com/open-policy-agent/opa/v1/loader"
+	"github.com/open-policy-agent/opa/v1/plugins"
 	"github.com/open-policy-agent/opa/v1/rego"
 	"github.com/open-policy-agent/opa/v1/sdk"
+	"github.com/open-policy-agent/opa/v1/storage"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+	"github.com/open-policy-agent/opa/v1/util"
 )
 
+// Plugin modes. In audit mode the policy is evaluated and its decision is
+// logged, but requests are never denied.
+const (
+	modeEnforce = "enforce"
+	modeAudit   = "audit"
+)
+
+// Failure modes, deciding whether requests are allowed or denied when the
+// policy cannot be evaluated.
+const (
+	failClosed = "closed"
+	failOpen   = "open"
+)
+
+// inputError is an error building the input of a request, like a malformed
+// request body. The failure mode only applies to errors evaluating the
+// policy, so requests whose input cannot be built are always denied.
+type inputError struct {
+	err error
+}
+
+func (e inputError) Error() string {
+	return e.err.Error()
+}
+
+func (e inputError) Unwrap() error {
+	return e.err
+}
+
 // DockerAuthZPlugin implements the authorization.Plugin interface. Every
 // request received by the Docker daemon will be forwarded to the AuthZReq
 // function. The AuthZReq function returns a response that indicates whether
 // the request should be allowed or denied.
 type DockerAuthZPlugin struct {
-	configFile    string
-	policyFile    string
-	allowPath     string
-	instanceID    string
-	skipPing      bool
-	quiet         bool
-	logOnlyDenied bool
-	opa           *sdk.OPA
+	configFile      string
+	policyFile      string
+	bundleFile      *bundleFile
+	policyDir       *policyDir
+	allowPath       string
+	routes          *routingTable
+	compile         compileOptions
+	instanceID      string
+	skipPing        bool
+	quiet           bool
+	logOnlyDenied   bool
+	logLevel        string
+	mode            string
+	failureMode     string
+	decisionTimeout time.Duration
+	candidate       *candidatePolicy
+	identity        *identityResolver
+	owners          *ownershipStore
+	tenants         *tenancy
+	usage           *usageTracker
+	schedule        *schedule
+	breakGlass      *breakGlassVerifier
+	approvals       *approvalQueue
+	policyHealth    *healthTracker
+	startup         *bundleStartup
+	cache           *decisionCache
+	generation      *storeGeneration
+	opa             *sdk.OPA
 }
 
 // AuthZReq is called when the Docker daemon receives an API request. AuthZReq
 // returns an authorization.Response that indicates whether the request should
 // be allowed or denied.
 func (p DockerAuthZPlugin) AuthZReq(r authorization.Request) authorization.Response {
+	return p.authorize(context.Background(), r)
+}
 
-	ctx := context.Background()
+// authorize decides whether the request should be allowed or denied. The
+// context may carry the credentials of the peer that made the request.
+func (p DockerAuthZPlugin) authorize(ctx context.Context, r authorization.Request) authorization.Response {
+
+	if (p.usage == nil && p.breakGlass == nil) || p.skipEvaluation(r) {
+		return p.enforce(ctx, r)
+	}
+
+	identity := p.identity.resolve(ctx, r)
+	if p.usage != nil {
+		ctx = withUsage(ctx, p.usage.take(usagePrincipal(identity)))
+	}
+	if bg, ok := p.breakGlass.resolve(ctx, r, identity); ok {
+		ctx = withBreakGlass(ctx, bg)
+	}
+
+	res := p.enforce(ctx, r)
+	if res.Allow {
+		p.usage.acquire(usagePrincipal(identity), r)
+	}
+
+	return res
+}
+
+// enforce evaluates the policy for the request, and applies its decision
+// according to the plugin mode and failure mode.
+func (p DockerAuthZPlugin) enforce(ctx context.Context, r authorization.Request) authorization.Response {
+
+	if p.decisionTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.decisionTimeout)
+		defer cancel()
+	}
+
+	var enforced chan outcome
+	if p.candidate != nil && !p.skipEvaluation(r) {
+		enforced = make(chan outcome, 1)
+		go p.candidate.compare(ctx, r, p.buildInput, enforced)
+	}
+
+	d, err := p.decide(ctx, r)
+	allowed := d.allow
+
+	result := decisionResult(allowed, err)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result = resultTimeout
+		err = fmt.Errorf("policy decision timed out after %v", p.decisionTimeout)
+		log.Printf("Policy evaluation of %s %s timed out after %v", r.RequestMethod, r.RequestURI, p.decisionTimeout)
+	}
+	decisionsTotal.WithLabelValues(p.mode, result).Inc()
+	if d.revision != "" {
+		recordPolicyRevision(d.revision)
+	}
+
+	if enforced != nil {
+		enforced <- outcome{allowed, err}
+	}
+
+	if bg, ok := ctx.Value(breakGlassContextKey{}).(BreakGlass); ok {
+		if p.auditBreakGlass(ctx, r, bg, d, err) {
+			return authorization.Response{Allow: true}
+		}
+	}
 
-	allowed, err := p.evaluate(ctx, r)
+	if p.mode == modeAudit {
+		return authorization.Response{Allow: true, Msg: d.warningMessage()}
+	}
+
+	if !allowed && err == nil && d.requiresApproval && p.approvals != nil {
+		if res, ok := p.requireApproval(ctx, r, d); ok {
+			return res
+		}
+	}
 
 	if allowed {
-		return authorization.Response{Allow: true}
+		return authorization.Response{Allow: true, Msg: d.warningMessage()}
 	} else if err != nil {
+		if p.failureMode == failOpen && !errors.As(err, &inputError{}) {
+			log.Printf("Failing open and allowing request after policy error: %v", err)
+			return authorization.Response{Allow: true, Msg: d.warningMessage()}
+		}
 		return authorization.Response{Err: err.Error()}
 	}
 
-	return authorization.Response{Msg: "request rejected by administrative policy"}
+	return authorization.Response{Msg: d.message()}
+}
+
+// requireApproval allows a request denied pending approval if an identical
+// request of the same principal was approved, and otherwise queues it for
+// approval. It returns false if the principal is not verified, since anyone
+// could otherwise replay the approved requests of another principal, or if
+// the queue failed.
+func (p DockerAuthZPlugin) requireApproval(ctx context.Context, r authorization.Request, d decision) (authorization.Response, bool) {
+
+	identity := p.identity.resolve(ctx, r)
+	if !identity.Verified {
+		return authorization.Response{}, false
+	}
+
+	req, err := p.approvals.check(identity.Name, r, d.reason)
+	if err != nil {
+		log.Printf("Failed queueing request for approval: %v", err)
+		return authorization.Response{}, false
+	}
+
+	switch req.Status {
+	case approvalApproved:
+		log.Printf("Allowing request %s of %s approved by %s", req.ID, req.Principal, req.Approver)
+		return authorization.Response{Allow: true}, true
+	case approvalRejected:
+		return authorization.Response{Msg: fmt.Sprintf("%s (request %s was rejected by %s)", d.message(), req.ID, req.Approver)}, true
+	}
+
+	return authorization.Response{Msg: fmt.Sprintf("%s (request %s is pending approval)", d.message(), req.ID)}, true
 }
 
 // AuthZRes is called before the Docker daemon returns an API response. All responses
-// are allowed.
-func (DockerAuthZPlugin) AuthZRes(authorization.Request) authorization.Response {
-	return authorization.Response{Allow: true}
+// are allowed, after recording the creators of new objects and the usage of principals.
+func (p DockerAuthZPlugin) AuthZRes(r authorization.Request) authorization.Response {
+	return p.authorizeResponse(context.Background(), r)
 }
 
-func (p DockerAuthZPlugin) evaluatePolicyFile(ctx context.Context, r authorization.Request) (bool, error) {
+func (p DockerAuthZPlugin) authorizeResponse(ctx context.Context, r authorization.Request) authorization.Response {
 
-	if _, err := os.Stat(p.policyFile); os.IsNotExist(err) {
-		log.Printf("OPA policy file %s does not exist, failing open and allowing request", p.policyFile)
-		return true, err
+	identity := sync.OnceValue(func() Identity {
+		return p.identity.resolve(ctx, r)
+	})
+
+	if err := p.owners.observe(r, func() string { return ownerPrincipal(identity()) }); err != nil {
+		log.Printf("Failed recording ownership for %s %s: %v", r.RequestMethod, r.RequestURI, err)
 	}
+	p.usage.observe(r, func() string { return usagePrincipal(identity()) })
+
+	return authorization.Response{Allow: true}
+}
 
-	bs, err := os.ReadFile(p.policyFile)
+// evalModule evaluates the allow decision at query against a single Rego
+// module compiled under c.
+func evalModule(ctx context.Context, c compileOptions, query, filename string, module []byte, input interface{}) (decision, error) {
+
+	eval := rego.New(append(c.regoOptions(),
+		rego.Query(query),
+		rego.Input(input),
+		rego.Module(filename, string(module)),
+	)...)
+
+	rs, err := eval.Eval(ctx)
 	if err != nil {
-		return false, err
+		return decision{}, err
 	}
 
-	input, err := makeInput(r)
-	if err != nil {
-		return false, err
+	if len(rs) == 0 {
+		// Decision is undefined. Fallback to deny.
+		return decision{}, nil
 	}
 
-	allowed, err := func() (bool, error) {
+	return parseDecision(rs[0].Expressions[0].Value)
+}
 
-		eval := rego.New(
-			rego.Query(p.allowPath),
-			rego.Input(input),
-			rego.Module(p.policyFile, string(bs)),
-		)
+// skipEvaluation reports whether the request is allowed without consulting
+// the policy.
+func (p DockerAuthZPlugin) skipEvaluation(r authorization.Request) bool {
+	return p.skipPing && r.RequestMethod == "HEAD" && r.RequestURI == "/_ping"
+}
 
-		rs, err := eval.Eval(ctx)
-		if err != nil {
-			return false, err
-		}
+// evaluate reports whether the policy allows the request.
+func (p DockerAuthZPlugin) evaluate(ctx context.Context, r authorization.Request) (bool, error) {
+	d, err := p.decide(ctx, r)
+	return d.allow, err
+}
 
-		if len(rs) == 0 {
-			// Decision is undefined. Fallback to deny.
-			return false, nil
-		}
+// decide evaluates the policy decision for the request, and logs it.
+func (p DockerAuthZPlugin) decide(ctx context.Context, r authorization.Request) (decision, error) {
 
-		allowed, ok := rs[0].Expressions[0].Value.(bool)
-		if !ok {
-			return false, fmt.Errorf("administrative policy decision invalid")
-		}
+	if p.skipEvaluation(r) {
+		return decision{allow: true}, nil
+	}
+
+	policy, err := p.evaluator().Policy(ctx)
+	if errors.Is(err, errNoPolicy) {
+		log.Printf("%v, failing open and allowing request", err)
+		return decision{allow: true}, err
+	} else if err != nil {
+		return decision{}, err
+	}
 
-		return allowed, nil
+	input, err := p.buildInput(ctx, r)
+	if err != nil {
+		return decision{}, inputError{err}
+	}
 
-	}()
+	// Decisions are cached by input, which includes the method and path
+	// routing the request, so cached decisions always come from the same
+	// entrypoint.
+	query := p.routes.entrypoint(r.RequestMethod, r.RequestURI, p.allowPath)
+	d, err := p.cachedDecision(r, policy.hash, input, func() (decision, error) {
+		return policy.eval(ctx, query, input)
+	})
+	if d.revision == "" {
+		d.revision = policy.revision
+	}
+	allowed := d.allow
 
-	decisionID, _ := uuid4()
-	configHash := sha256.Sum256(bs)
+	decisionID := d.id
+	if decisionID == "" {
+		decisionID, _ = uuid4()
+	}
 	labels := map[string]string{
 		"app":            "opa-docker-authz",
 		"id":             p.instanceID,
 		"opa_version":    version_pkg.OPAVersion,
 		"plugin_version": version_pkg.Version,
+		"mode":           p.mode,
 	}
 	decisionLog := map[string]interface{}{
 		"labels":      labels,
 		"decision_id": decisionID,
-		"config_hash": hex.EncodeToString(configHash[:]),
+		"config_hash": policy.hash,
+		"revision":    d.revision,
 		"input":       input,
 		"result":      allowed,
 		"timestamp":   time.Now().Format(time.RFC3339Nano),
 	}
+	if d.reason != "" {
+		decisionLog["reason"] = d.reason
+	}
+	if p.routes != nil {
+		decisionLog["entrypoint"] = query
+	}
+	if len(d.warnings) > 0 {
+		decisionLog["warnings"] = d.warnings
+	}
+	if d.tags != nil {
+		decisionLog["tags"] = d.tags
+	}
+	if d.logLevel != "" {
+		decisionLog["level"] = d.logLevel
+	}
+	if p.mode == modeAudit {
+		decisionLog["shadow"] = true
+	}
 
 	if err != nil {
 		i, _ := json.Marshal(input)
 		log.Printf("Returning OPA policy decision: %v (error: '%v'; input: '%v')", allowed, err, string(i))
-	} else {
-		if !p.quiet {
-			if !p.logOnlyDenied || !allowed {
-				dl, _ := json.Marshal(decisionLog)
-				log.Printf("Returning OPA policy decision: %v: %s", allowed, string(dl))
-			}
-		}
+	} else if p.logsDecision(d) {
+		dl, _ := json.Marshal(decisionLog)
+		log.Printf("Returning OPA policy decision: %v: %s", allowed, string(dl))
 	}
 
-	return allowed, err
+	return d, err
 }
 
-func (p DockerAuthZPlugin) evaluate(ctx context.Context, r authorization.Request) (bool, error) {
+// cachedDecision returns the cached decision for a cacheable request, and
+// otherwise calls eval, caching its decision if the request is cacheable.
+// Failed evaluations are never cached.
+func (p DockerAuthZPlugin) cachedDecision(r authorization.Request, revision string, input interface{}, eval func() (decision, error)) (decision, error) {
 
-	if p.skipPing && r.RequestMethod == "HEAD" && r.RequestURI == "/_ping" {
-		return true, nil
+	if !p.cache.cacheable(r.RequestMethod, r.RequestURI) {
+		return eval()
 	}
 
-	if p.configFile != "" {
-		input, err := makeInput(r)
-		if err != nil {
-			return false, err
-		}
-
-		decisionOptions := sdk.DecisionOptions{
-			Input: input,
-			Path:  p.allowPath,
-		}
-
-		result, err := p.opa.Decision(ctx, decisionOptions)
-		if err != nil {
-			return false, err
-		}
+	key, err := p.cache.key(revision, input)
+	if err != nil {
+		return eval()
+	}
 
-		decision, ok := result.Result.(bool)
-		if !ok || !decision {
-			return false, nil
-		}
-		return true, nil
+	if d, ok := p.cache.get(revision, key); ok {
+		return d, nil
+	}
 
+	d, err := eval()
+	if err == nil {
+		// Cached decisions are new decisions, logged with their own ID.
+		cached := d
+		cached.id = ""
+		p.cache.add(revision, key, cached)
 	}
 
-	return p.evaluatePolicyFile(ctx, r)
+	return d, err
 }
 
 type BindMount struct {
@@ -234,11 +449,33 @@ func listBindMounts(body map[string]interface{}) []BindMount {
 	return result
 }
 
-func makeInput(r authorization.Request) (interface{}, error) {
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)?(/|$)`)
+
+// apiPath returns the path of a Docker API request URI without its query
+// string and API version prefix, e.g. /containers/json for
+// /v1.47/containers/json?all=1.
+func apiPath(uri string) string {
+
+	path, _, _ := strings.Cut(uri, "?")
+	if loc := apiVersionPrefix.FindStringIndex(path); loc != nil {
+		return "/" + path[loc[1]:]
+	}
+
+	return path
+}
+
+// isJSON reports whether a Content-Type header is the JSON media type,
+// whatever its parameters, like application/json; charset=utf-8.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/json"
+}
+
+func makeInput(r authorization.Request) (map[string]interface{}, error) {
 
 	var body map[string]interface{}
 
-	if r.RequestHeaders["Content-Type"] == "application/json" && len(r.RequestBody) > 0 {
+	if isJSON(r.RequestHeaders["Content-Type"]) && len(r.RequestBody) > 0 {
 		if err := json.Unmarshal(r.RequestBody, &body); err != nil {
 			return nil, err
 		}
@@ -267,6 +504,37 @@ func makeInput(r authorization.Request) (interface{}, error) {
 	return input, nil
 }
 
+// buildInput builds the input document of a request, including the identity
+// of the principal making it.
+func (p DockerAuthZPlugin) buildInput(ctx context.Context, r authorization.Request) (map[string]interface{}, error) {
+
+	input, err := makeInput(r)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := p.identity.resolve(ctx, r)
+	input["Identity"] = identity
+	if target, ok := p.owners.target(r.RequestURI); ok {
+		input["Target"] = target
+	}
+	if p.tenants != nil {
+		body, _ := input["Body"].(map[string]interface{})
+		input["Tenant"] = p.tenants.resolve(identity, r, body)
+	}
+	if usage, ok := ctx.Value(usageContextKey{}).(Usage); ok {
+		input["Usage"] = usage
+	}
+	if bg, ok := ctx.Value(breakGlassContextKey{}).(BreakGlass); ok {
+		input["BreakGlass"] = bg
+	}
+	if p.schedule != nil {
+		input["Time"] = p.schedule.at(time.Now())
+	}
+
+	return input, nil
+}
+
 func uuid4() (string, error) {
 
 	bs := make([]byte, 16)
@@ -279,11 +547,17 @@ func uuid4() (string, error) {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", bs[0:4], bs[4:6], bs[6:8], bs[8:10], bs[10:]), nil
 }
 
-func regoSyntax(p string) int {
+func regoSyntax(p string, c compileOptions) int {
 
 	stuffs := []string{p}
 
-	result, err := loader.AllRegos(stuffs)
+	result, err := loader.NewFileLoader().
+		WithRegoVersion(c.regoVersion).
+		WithCapabilities(c.capabilities).
+		WithProcessAnnotation(true).
+		Filtered(stuffs, func(_ string, info os.FileInfo, _ int) bool {
+			return !info.IsDir() && !strings.HasSuffix(info.Name(), bundle.RegoExt)
+		})
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		return 1
@@ -295,10 +569,8 @@ func regoSyntax(p string) int {
 		modules[m.Name] = m.Parsed
 	}
 
-	compiler := ast.NewCompiler().SetErrorLimit(0)
-
-	if compiler.Compile(modules); compiler.Failed() {
-		for _, err := range compiler.Errors {
+	if err := c.compile(modules); err != nil {
+		for _, err := range err.(ast.Errors) {
 			_, _ = fmt.Fprintln(os.Stderr, err)
 		}
 		return 1
@@ -307,26 +579,58 @@ func regoSyntax(p string) int {
 	return 0
 }
 
-func initOPA(ctx context.Context, configFile string) (*sdk.OPA, error) {
+// initOPA creates the OPA instance of config-file mode. If ready is nil, it
+// blocks until the bundles are activated, and otherwise returns immediately
+// and closes ready once they are.
+func initOPA(ctx context.Context, configFile string, labels map[string]string, store storage.Store, ready chan struct{}, opts ...func(*plugins.Manager)) (*sdk.OPA, error) {
 
-	buf, err := os.Open(configFile)
+	bs, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	defer func() {
-		if err = buf.Close(); err != nil {
-			log.Fatal(err)
-		}
-	}()
+	bs, err = withLabels(bs, labels)
+	if err != nil {
+		return nil, err
+	}
 
 	options := sdk.Options{
-		Config: buf,
+		Config:      bytes.NewReader(bs),
+		Store:       store,
+		Ready:       ready,
+		ManagerOpts: opts,
 	}
 
 	return sdk.New(ctx, options)
 }
 
+// withLabels adds the given labels to an OPA configuration, so they are
+// reported in decision logs and status updates. Labels already set in the
+// configuration take precedence.
+func withLabels(config []byte, labels map[string]string) ([]byte, error) {
+
+	var parsed map[string]interface{}
+	if err := util.Unmarshal(config, &parsed); err != nil {
+		return nil, err
+	}
+	if parsed == nil {
+		parsed = map[string]interface{}{}
+	}
+
+	existing, ok := parsed["labels"].(map[string]interface{})
+	if !ok {
+		existing = map[string]interface{}{}
+	}
+	for k, v := range labels {
+		if _, ok := existing[k]; !ok {
+			existing[k] = v
+		}
+	}
+	parsed["labels"] = existing
+
+	return json.Marshal(parsed)
+}
+
 func normalizeAllowPath(path string, useConfig bool) string {
 
 	if useConfig && strings.HasPrefix(path, "data") {
@@ -340,15 +644,74 @@ func normalizeAllowPath(path string, useConfig bool) string {
 
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "break-glass":
+			os.Exit(breakGlassCommand(os.Args[2:]))
+		case "approve":
+			os.Exit(approveCommand(os.Args[2:]))
+		}
+	}
+
 	pluginName := flag.String("plugin-name", "opa-docker-authz", "sets the plugin name that will be registered with Docker")
 	allowPath := flag.String("allowPath", "data.docker.authz.allow", "sets the path of the allow decision in OPA")
+	routesFile := flag.String("routes-file", "", "sets the path of the YAML or JSON file routing requests to policy entrypoints other than allowPath")
 	configFile := flag.String("config-file", "", "sets the path of the config file to load")
 	policyFile := flag.String("policy-file", "", "sets the path of the policy file to load")
+	policyBundle := flag.String("policy-bundle", "", "sets the path of the policy bundle archive to load")
+	policyDirPath := flag.String("policy-dir", "", "sets the path of a local bundle directory to load, and to load again whenever it changes")
+	verificationKey := flag.String("verification-key", "", "sets the PEM encoded public key, or the path of a file holding it, verifying the signatures of the policy bundle")
+	verificationKeyID := flag.String("verification-key-id", "default", "sets the name of the key verifying the signatures of the policy bundle")
+	signingAlg := flag.String("signing-alg", "RS256", "sets the algorithm of the signatures of the policy bundle")
 	skipPing := flag.Bool("skip-ping", true, "skip policy evaluation for requests to /_ping endpoint")
 	version := flag.Bool("version", false, "print the version of the plugin")
 	check := flag.Bool("check", false, "checks the syntax of the policy-file")
-	quiet := flag.Bool("quiet", false, "disable logging of each HTTP request (policy-file mode)")
-	logOnlyDenied := flag.Bool("log-only-denied", false, "only log denied requests (policy-file mode)")
+	capabilitiesFile := flag.String("capabilities", "", "sets the path of the OPA capabilities JSON file restricting the built-in functions and features policies may use")
+	strict := flag.Bool("strict", false, "compiles policies in strict mode")
+	regoVersion := flag.String("rego-version", "v1", "sets the Rego version policies are parsed with: v0 or v1")
+	quiet := flag.Bool("quiet", false, "disable logging of each HTTP request")
+	logOnlyDenied := flag.Bool("log-only-denied", false, "only log denied requests")
+	logLevel := flag.String("log-level", logLevelInfo, "sets the minimum level of logged decisions: debug, info, warn or error")
+	mode := flag.String("mode", modeEnforce, "sets the plugin mode: enforce, or audit to evaluate policy without denying requests")
+	failureMode := flag.String("failure-mode", failClosed, "sets how policy evaluation errors are handled: closed denies the request, open allows it")
+	decisionTimeout := flag.Duration("decision-timeout", 0, "sets the maximum time spent evaluating the policy for a request (0 disables the deadline)")
+	candidateFile := flag.String("candidate-policy-file", "", "sets the path of a candidate policy file evaluated alongside the enforced policy")
+	candidateAllowPath := flag.String("candidate-allow-path", "", "sets the path of the allow decision in the candidate policy (defaults to allowPath)")
+	candidateTimeout := flag.Duration("candidate-timeout", 100*time.Millisecond, "sets the maximum time spent evaluating the candidate policy")
+	cacheSize := flag.Int("cache-size", 0, "sets the maximum number of decisions cached for cacheable requests (0 disables the cache)")
+	cacheTTL := flag.Duration("cache-ttl", time.Second, "sets how long a cached decision may be reused")
+	cacheRules := flag.String("cache-rules", defaultCacheRules, "sets the comma separated METHOD:/path rules of requests whose decisions may be cached")
+	identitySources := flag.String("identity-sources", defaultIdentitySources, "sets the comma separated identity sources consulted in order: peercred, daemon, certificate, jwt and header")
+	identityHeader := flag.String("identity-header", "Authz-User", "sets the request header holding the unverified principal of the header identity source")
+	identityJWTHeader := flag.String("identity-jwt-header", "Authorization", "sets the request header holding the token of the jwt identity source")
+	identityJWTClaim := flag.String("identity-jwt-claim", "sub", "sets the token claim naming the principal of the jwt identity source")
+	identityJWKSFile := flag.String("identity-jwks-file", "", "sets the path of the JWKS file used to verify tokens of the jwt identity source")
+	identityJWTIssuer := flag.String("identity-jwt-issuer", "", "sets the issuer required of tokens of the jwt identity source")
+	identityJWTAudience := flag.String("identity-jwt-audience", "", "sets the audience required of tokens of the jwt identity source")
+	identityDirectoryFile := flag.String("identity-directory-file", "", "sets the path of the YAML or JSON file mapping principals to their groups")
+	listen := flag.String("listen", "", "sets the address to serve the plugin API on: unix:///path/to.sock or tcp://host:port (defaults to the plugin socket)")
+	tlsCertFile := flag.String("tls-cert-file", "", "sets the path of the TLS certificate served on tcp:// listeners")
+	tlsKeyFile := flag.String("tls-private-key-file", "", "sets the path of the TLS private key served on tcp:// listeners")
+	tlsCACertFile := flag.String("tls-ca-cert-file", "", "sets the path of the CA certificate used to require and verify client certificates")
+	specDir := flag.String("spec-dir", "/etc/docker/plugins", "sets the directory the plugin spec file is written to when using -listen (empty disables it)")
+	specTLSCAFile := flag.String("spec-tls-ca-file", "", "sets the CA certificate the Docker daemon uses to verify the plugin, written to the spec file")
+	specTLSCertFile := flag.String("spec-tls-cert-file", "", "sets the client certificate the Docker daemon presents to the plugin, written to the spec file")
+	specTLSKeyFile := flag.String("spec-tls-key-file", "", "sets the client private key of the Docker daemon, written to the spec file")
+	proxyListen := flag.String("proxy-listen", "", "sets the unix:///path of an optional socket proxying the Docker API, authorizing requests by the credentials of the connecting process")
+	proxyUpstream := flag.String("proxy-upstream", "unix:///var/run/docker.sock", "sets the address of the Docker API the proxy forwards allowed requests to")
+	ownershipFile := flag.String("ownership-file", "", "sets the path of the file recording the creators of containers, volumes and networks (empty disables ownership tracking)")
+	tenantsFile := flag.String("tenants-file", "", "sets the path of the YAML or JSON file mapping principals to tenants and their naming rules")
+	quotasFile := flag.String("quotas-file", "", "sets the path of the YAML or JSON file defining the request rate and usage quotas of principals")
+	scheduleFile := flag.String("schedule-file", "", "sets the path of the YAML or JSON file defining the named time windows exposed to policy")
+	breakGlassKeyFile := flag.String("break-glass-public-key-file", "", "sets the path of the PEM encoded public key verifying break-glass tokens (empty disables break-glass overrides)")
+	breakGlassHeader := flag.String("break-glass-header", "X-Break-Glass", "sets the request header holding break-glass tokens")
+	approvalsFile := flag.String("approvals-file", "", "sets the path of the file queueing requests the policy requires approval for (empty disables approvals)")
+	approvalTTL := flag.Duration("approval-ttl", time.Hour, "sets how long an approved request may be repeated by its principal")
+	approvalsListen := flag.String("approvals-listen", defaultApprovalsListen, "sets the unix:///path of the socket serving the approval API when approvals are enabled")
+	approvalsGroup := flag.String("approvals-group", "", "sets the group owning the approval socket, whose members may decide requests (defaults to the group of the plugin)")
+	startupMode := flag.String("startup-mode", startupBlock, "sets whether config-file mode waits for its bundles to be activated before serving requests (block), or serves them meanwhile (background)")
+	fallbackPolicyFile := flag.String("fallback-policy-file", "", "sets the path of the policy file deciding requests until the bundles are activated in background startup mode (defaults to the failure mode)")
+	managementAddr := flag.String("management-addr", "", "sets the address of the optional HTTP listener serving metrics and health endpoints (e.g. localhost:9102)")
 
 	flag.Parse()
 
@@ -358,42 +721,252 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *mode != modeEnforce && *mode != modeAudit {
+		log.Fatalf("Invalid mode %q, must be one of %s or %s", *mode, modeEnforce, modeAudit)
+	}
+
+	if _, ok := logLevels[*logLevel]; !ok {
+		log.Fatalf("Invalid log level %q, must be one of debug, info, warn or error", *logLevel)
+	}
+
+	if *failureMode != failClosed && *failureMode != failOpen {
+		log.Fatalf("Invalid failure mode %q, must be one of %s or %s", *failureMode, failClosed, failOpen)
+	}
+
+	compile, err := newCompileOptions(*capabilitiesFile, *strict, *regoVersion)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
 	useConfig := *configFile != ""
 
-	var opa *sdk.OPA
-	if useConfig {
-		if *policyFile != "" {
-			log.Fatal("Only one of config-file and policy-file arguments allowed")
+	sources := 0
+	for _, source := range []string{*configFile, *policyFile, *policyBundle, *policyDirPath} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		log.Fatal("Only one of config-file, policy-file, policy-bundle and policy-dir arguments allowed")
+	}
+
+	if *verificationKey != "" && *policyBundle == "" {
+		log.Fatal("The verification-key argument requires policy-bundle")
+	}
+
+	listener := listenConfig{
+		pluginName:      *pluginName,
+		addr:            *listen,
+		tlsCertFile:     *tlsCertFile,
+		tlsKeyFile:      *tlsKeyFile,
+		tlsCACertFile:   *tlsCACertFile,
+		specDir:         *specDir,
+		specTLSCAFile:   *specTLSCAFile,
+		specTLSCertFile: *specTLSCertFile,
+		specTLSKeyFile:  *specTLSKeyFile,
+	}
+	if err := listener.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if fb, err := embeddedFallback(); err != nil {
+		log.Fatalf("Invalid embedded fallback bundle: %v", err)
+	} else if fb != nil {
+		log.Printf("Embedded fallback policy %s is available.", fb.revision)
+	}
+
+	if *startupMode != startupBlock && *startupMode != startupBackground {
+		log.Fatalf("Invalid startup mode %q, must be one of %s or %s", *startupMode, startupBlock, startupBackground)
+	}
+
+	identity, err := newIdentityResolver(ctx, identityConfig{
+		sources:       *identitySources,
+		header:        *identityHeader,
+		jwtHeader:     *identityJWTHeader,
+		jwtClaim:      *identityJWTClaim,
+		jwksFile:      *identityJWKSFile,
+		jwtIssuer:     *identityJWTIssuer,
+		jwtAudience:   *identityJWTAudience,
+		directoryFile: *identityDirectoryFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	instanceID, _ := uuid4()
+	p := DockerAuthZPlugin{
+		configFile:      *configFile,
+		policyFile:      *policyFile,
+		allowPath:       normalizeAllowPath(*allowPath, false),
+		compile:         compile,
+		instanceID:      instanceID,
+		skipPing:        *skipPing,
+		quiet:           *quiet,
+		logOnlyDenied:   *logOnlyDenied,
+		logLevel:        *logLevel,
+		mode:            *mode,
+		failureMode:     *failureMode,
+		decisionTimeout: *decisionTimeout,
+		identity:        identity,
+	}
+
+	if *policyBundle != "" {
+		p.bundleFile, err = newBundleFile(*policyBundle, *verificationKey, *verificationKeyID, *signingAlg, compile)
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		var err error
-		opa, err = initOPA(ctx, *configFile)
+	if *policyDirPath != "" {
+		p.policyDir, err = loadPolicyDir(*policyDirPath, compile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer opa.Stop(ctx)
+		go func() {
+			if err := p.policyDir.watch(ctx); err != nil {
+				log.Printf("Stopped watching policy directory %s: %v", *policyDirPath, err)
+			}
+		}()
 	}
 
-	instanceID, _ := uuid4()
-	p := DockerAuthZPlugin{
-		configFile:    *configFile,
-		policyFile:    *policyFile,
-		allowPath:     normalizeAllowPath(*allowPath, useConfig),
-		instanceID:    instanceID,
-		skipPing:      *skipPing,
-		quiet:         *quiet,
-		logOnlyDenied: *logOnlyDenied,
-		opa:           opa,
+	if *routesFile != "" {
+		p.routes, err = loadRoutingTable(*routesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *ownershipFile != "" {
+		p.owners, err = loadOwnershipStore(*ownershipFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *tenantsFile != "" {
+		p.tenants, err = loadTenancy(*tenantsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *quotasFile != "" {
+		p.usage, err = loadUsageTracker(*quotasFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *scheduleFile != "" {
+		p.schedule, err = loadSchedule(*scheduleFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *breakGlassKeyFile != "" {
+		p.breakGlass, err = newBreakGlassVerifier(ctx, *breakGlassHeader, *breakGlassKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *approvalsFile != "" {
+		p.approvals, err = loadApprovalQueue(*approvalsFile, *approvalTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *cacheSize > 0 {
+		rules, err := parseCacheRules(*cacheRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p.cache = newDecisionCache(*cacheSize, *cacheTTL, rules)
+	}
+
+	if *candidateFile != "" {
+		if *candidateAllowPath == "" {
+			candidateAllowPath = allowPath
+		}
+		p.candidate = &candidatePolicy{
+			policyFile: *candidateFile,
+			allowPath:  normalizeAllowPath(*candidateAllowPath, false),
+			timeout:    *candidateTimeout,
+			compile:    compile,
+		}
 	}
 
 	if *check && *policyFile != "" {
-		os.Exit(regoSyntax(*policyFile))
+		os.Exit(regoSyntax(*policyFile, compile))
+	}
+
+	if useConfig {
+		p.policyHealth = newHealthTracker(compile)
+		if *startupMode == startupBackground {
+			p.startup = newBundleStartup(*fallbackPolicyFile)
+		}
+	}
+
+	// The management server is started before the OPA instance, which may
+	// block until its bundles are activated, so readiness can be monitored.
+	if *managementAddr != "" {
+		go serveManagement(*managementAddr, p)
+	}
+
+	if p.approvals != nil {
+		go func() {
+			err := approvalConfig{addr: *approvalsListen, group: *approvalsGroup}.serve(p.approvals)
+			log.Fatalf("Failed serving approvals: %v", err)
+		}()
+	}
+
+	if useConfig {
+		store := inmem.New()
+
+		p.generation, err = watchStore(ctx, store)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := insertLib(ctx, store); err != nil {
+			log.Fatal(err)
+		}
+
+		var ready chan struct{}
+		if p.startup != nil {
+			ready = p.startup.ready
+			go p.startup.wait(ctx)
+		}
+
+		p.opa, err = initOPA(ctx, *configFile, map[string]string{"mode": *mode}, store, ready, p.policyHealth.managerOption(), libManagerOption(), compile.managerOption())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer p.opa.Stop(ctx)
+	}
+
+	if *proxyListen != "" {
+		go func() {
+			err := proxyConfig{pluginName: *pluginName, addr: *proxyListen, upstream: *proxyUpstream}.serve(p)
+			log.Fatalf("Failed serving proxy: %v", err)
+		}()
 	}
 
 	h := authorization.NewHandler(p)
 	log.Println("Starting server.")
-	err := h.ServeUnix(*pluginName, 0)
+
+	if *listen == "" {
+		err = h.ServeUnix(*pluginName, 0)
+	} else {
+		// The Docker daemon and systemd stop the plugin with SIGTERM, which
+		// must stop the listener so the spec file is removed.
+		serveCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = listener.serve(serveCtx, h)
+	}
 	if err != nil {
 		log.Printf("Failed serving on socket: %v", err)
 	}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/authorization"
 )
@@ -232,7 +233,7 @@ func TestEvaluate(t *testing.T) {
 			policyFile:     "nonexistent.rego",
 			allowPath:      "data.docker.authz.allow",
 			request:        authorization.Request{RequestMethod: "GET"},
-			expectedResult: true, // policy file nonexistent.rego does not exist, failing open and allowing request
+			expectedResult: false,
 			expectedError:  true,
 		},
 		{
@@ -264,3 +265,165 @@ func TestEvaluate(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthZReqAuditMode(t *testing.T) {
+	request := authorization.Request{
+		RequestMethod: "POST",
+		RequestURI:    "/v1.23/containers/create",
+		RequestBody:   []byte(`{"Image": "busybox"}`),
+		RequestHeaders: map[string]string{
+			"Content-Type": "application/json",
+			"Authz-User":   "bob",
+		},
+	}
+
+	tests := []struct {
+		mode          string
+		expectedAllow bool
+	}{
+		{mode: modeEnforce, expectedAllow: false},
+		{mode: modeAudit, expectedAllow: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.mode, func(t *testing.T) {
+			plugin := DockerAuthZPlugin{
+				policyFile: "example.rego",
+				allowPath:  "data.docker.authz.allow",
+				instanceID: "test-instance",
+				quiet:      true,
+				mode:       tc.mode,
+			}
+			response := plugin.AuthZReq(request)
+			if response.Allow != tc.expectedAllow {
+				t.Errorf("Expected allow: %v, got: %v", tc.expectedAllow, response.Allow)
+			}
+		})
+	}
+}
+
+func TestWithLabels(t *testing.T) {
+	config := []byte("labels:\n  mode: custom\nservices:\n  acme:\n    url: https://example.com\n")
+
+	bs, err := withLabels(config, map[string]string{"mode": modeAudit, "region": "eu"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(bs, &result); err != nil {
+		t.Fatalf("Improper JSON output - got %v", err)
+	}
+
+	expected := map[string]interface{}{"mode": "custom", "region": "eu"}
+	if !reflect.DeepEqual(result["labels"], expected) {
+		t.Errorf("Expected labels %v, got %v", expected, result["labels"])
+	}
+	if _, ok := result["services"]; !ok {
+		t.Errorf("Expected services to be preserved, got %v", result)
+	}
+}
+
+func TestAuthZReqDecisionTimeout(t *testing.T) {
+	tests := []struct {
+		failureMode   string
+		expectedAllow bool
+		expectedErr   bool
+	}{
+		{failureMode: failClosed, expectedAllow: false, expectedErr: true},
+		{failureMode: failOpen, expectedAllow: true, expectedErr: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.failureMode, func(t *testing.T) {
+			plugin := DockerAuthZPlugin{
+				policyFile:      "testdata/slow.rego",
+				allowPath:       "data.docker.authz.allow",
+				instanceID:      "test-instance",
+				quiet:           true,
+				mode:            modeEnforce,
+				failureMode:     tc.failureMode,
+				decisionTimeout: 10 * time.Millisecond,
+			}
+			timeouts := counterValue(t, decisionsTotal.WithLabelValues(modeEnforce, resultTimeout))
+
+			start := time.Now()
+			response := plugin.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"})
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("Expected decision to be cancelled, took %v", elapsed)
+			}
+
+			if response.Allow != tc.expectedAllow {
+				t.Errorf("Expected allow: %v, got: %v", tc.expectedAllow, response.Allow)
+			}
+			if (response.Err != "") != tc.expectedErr {
+				t.Errorf("Expected error: %v, got: %q", tc.expectedErr, response.Err)
+			}
+			if got := counterValue(t, decisionsTotal.WithLabelValues(modeEnforce, resultTimeout)) - timeouts; got != 1 {
+				t.Errorf("Expected one timed out decision, got %v", got)
+			}
+		})
+	}
+}
+
+func TestAuthZReqFailOpenInputError(t *testing.T) {
+	plugin := DockerAuthZPlugin{
+		policyFile:  "testdata/default_allow.rego",
+		allowPath:   "data.docker.authz.allow",
+		instanceID:  "test-instance",
+		quiet:       true,
+		mode:        modeEnforce,
+		failureMode: failOpen,
+	}
+
+	response := plugin.AuthZReq(authorization.Request{
+		RequestMethod:  "POST",
+		RequestURI:     "/v1.47/containers/create",
+		RequestHeaders: map[string]string{"Content-Type": "application/json"},
+		RequestBody:    []byte(`{"HostConfig": {"Privileged": true}`),
+	})
+	if response.Allow || response.Err == "" {
+		t.Errorf("Expected a malformed request to be denied in fail-open mode, got %+v", response)
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON", true},
+		{"application/jsonp", false},
+		{"text/plain", false},
+		{"", false},
+	}
+
+	for _, tc := range tests {
+		if result := isJSON(tc.contentType); result != tc.expected {
+			t.Errorf("%q: expected %v, got %v", tc.contentType, tc.expected, result)
+		}
+	}
+}
+
+func TestAPIPath(t *testing.T) {
+	tests := []struct {
+		uri      string
+		expected string
+	}{
+		{"/v1.47/containers/json?all=1", "/containers/json"},
+		{"/containers/json", "/containers/json"},
+		{"/v1/_ping", "/_ping"},
+		{"/v1.47", "/"},
+		{"/volumes/v1.2", "/volumes/v1.2"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			if result := apiPath(tc.uri); result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
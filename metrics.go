@@ -0,0 +1,90 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Decision outcomes used as the "result" label of the decision metrics.
+const (
+	resultAllow   = "allow"
+	resultDeny    = "deny"
+	resultError   = "error"
+	resultTimeout = "timeout"
+)
+
+var decisionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "opa_docker_authz",
+		Name:      "decisions_total",
+		Help:      "Number of authorization decisions made by the policy, by plugin mode and result.",
+	},
+	[]string{"mode", "result"},
+)
+
+var policyInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "opa_docker_authz",
+		Name:      "policy_info",
+		Help:      "Revision of the policy that made the latest decision, as bundle@revision pairs in config-file mode or the policy file hash.",
+	},
+	[]string{"revision"},
+)
+
+var policyRevision struct {
+	mtx      sync.Mutex
+	revision string
+}
+
+func init() {
+	prometheus.MustRegister(decisionsTotal, policyInfo)
+}
+
+// recordPolicyRevision exposes the revision of the policy that made the
+// latest decision.
+func recordPolicyRevision(revision string) {
+
+	policyRevision.mtx.Lock()
+	defer policyRevision.mtx.Unlock()
+
+	if revision == policyRevision.revision {
+		return
+	}
+	policyRevision.revision = revision
+
+	policyInfo.Reset()
+	policyInfo.WithLabelValues(revision).Set(1)
+}
+
+// decisionResult maps the outcome of a policy evaluation to a metric label.
+func decisionResult(allowed bool, err error) string {
+	if err != nil {
+		return resultError
+	}
+	if allowed {
+		return resultAllow
+	}
+	return resultDeny
+}
+
+// serveManagement starts the optional HTTP listener exposing the Prometheus
+// metrics and health of the plugin. It does not return.
+func serveManagement(addr string, p DockerAuthZPlugin) {
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	registerHealthHandlers(mux, p)
+
+	log.Printf("Starting management server on %s.", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("Failed serving management endpoints: %v", err)
+	}
+}
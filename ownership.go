@@ -0,0 +1,379 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// Target is the Docker object a request refers to, exposed to policy as
+// input.Target. ID and Owner are only set for objects whose creation was
+// recorded by the plugin.
+type Target struct {
+	Type  string
+	Ref   string
+	ID    string
+	Owner string
+}
+
+// ownerRecord records the principal that created a Docker object.
+type ownerRecord struct {
+	Type    string    `json:"type"`
+	Owner   string    `json:"owner"`
+	Names   []string  `json:"names,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// ownershipStore tracks the creators of containers, volumes and networks,
+// persisting them to a JSON file. Objects are keyed by their ID, or by their
+// name for volumes. A nil *ownershipStore tracks nothing.
+type ownershipStore struct {
+	mtx     sync.Mutex
+	file    string
+	objects map[string]*ownerRecord
+}
+
+// loadOwnershipStore loads the ownership records persisted in file, which
+// is created on the first recorded object if it does not exist.
+func loadOwnershipStore(file string) (*ownershipStore, error) {
+
+	s := &ownershipStore{file: file, objects: map[string]*ownerRecord{}}
+
+	bs, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &s.objects); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// target returns the Target of a request URI, if it refers to a Docker
+// object.
+func (s *ownershipStore) target(uri string) (*Target, bool) {
+
+	route := parseRoute(uri)
+	if route.Type == "" || route.Ref == "" {
+		return nil, false
+	}
+
+	target := &Target{Type: route.Type, Ref: route.Ref}
+	if s == nil {
+		return target, true
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if id, record := s.lookup(route.Type, route.Ref); record != nil {
+		target.ID = id
+		target.Owner = record.Owner
+	}
+
+	return target, true
+}
+
+// lookup finds the record of an object by its ID, name or unique ID prefix,
+// like the Docker daemon resolves references. Names are unique among the
+// records of a type, but should records persisted by an earlier version
+// share a name, the most recently created object wins. The caller must hold
+// the lock.
+func (s *ownershipStore) lookup(typ, ref string) (string, *ownerRecord) {
+
+	if record, ok := s.objects[ref]; ok && record.Type == typ {
+		return ref, record
+	}
+
+	var named string
+	for id, record := range s.objects {
+		if record.Type != typ || !slices.Contains(record.Names, ref) {
+			continue
+		}
+		if named == "" || record.Created.After(s.objects[named].Created) ||
+			(record.Created.Equal(s.objects[named].Created) && id < named) {
+			named = id
+		}
+	}
+	if named != "" {
+		return named, s.objects[named]
+	}
+
+	var found string
+	for id, record := range s.objects {
+		if record.Type == typ && strings.HasPrefix(id, ref) {
+			if found != "" {
+				return "", nil
+			}
+			found = id
+		}
+	}
+	if found != "" {
+		return found, s.objects[found]
+	}
+
+	return "", nil
+}
+
+// observe updates the records after a successful API response: created
+// objects are recorded with the principal returned by owner, removed and
+// pruned objects are forgotten, and renamed containers are renamed. The
+// names the daemon generated for containers are learned from the responses
+// listing or inspecting them.
+func (s *ownershipStore) observe(r authorization.Request, owner func() string) error {
+
+	if s == nil || r.ResponseStatusCode < 200 || r.ResponseStatusCode > 299 {
+		return nil
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	route := parseRoute(r.RequestURI)
+	if route.Type == "" {
+		return nil
+	}
+
+	switch {
+	case route.Ref == "" && route.Action == "create" && r.RequestMethod == http.MethodPost:
+		return s.created(route.Type, r, owner())
+	case route.Ref == "" && route.Action == "prune" && r.RequestMethod == http.MethodPost:
+		return s.pruned(route.Type, r)
+	case route.Action == "json" && r.RequestMethod == http.MethodGet:
+		return s.inspected(route.Type, route.Ref == "", r)
+	}
+
+	id, record := s.lookup(route.Type, route.Ref)
+	if record == nil {
+		return nil
+	}
+
+	switch {
+	case r.RequestMethod == http.MethodDelete && route.Action == "":
+		delete(s.objects, id)
+	case r.RequestMethod == http.MethodPost && route.Action == "rename":
+		u, err := url.Parse(r.RequestURI)
+		if err != nil {
+			return err
+		}
+		s.name(route.Type, id, []string{strings.TrimPrefix(u.Query().Get("name"), "/")})
+	default:
+		return nil
+	}
+
+	return s.save()
+}
+
+// name sets the names of the object id, taking them from the records of
+// other objects of the same type, which were removed without the plugin
+// knowing, like containers run with --rm. It reports whether any record
+// changed. The caller must hold the lock.
+func (s *ownershipStore) name(typ, id string, names []string) bool {
+
+	changed := false
+	for otherID, record := range s.objects {
+		if otherID == id || record.Type != typ {
+			continue
+		}
+		kept := slices.DeleteFunc(slices.Clone(record.Names), func(name string) bool {
+			return slices.Contains(names, name)
+		})
+		if len(kept) != len(record.Names) {
+			record.Names = kept
+			changed = true
+		}
+	}
+
+	if record, ok := s.objects[id]; ok && !slices.Equal(record.Names, names) {
+		record.Names = names
+		changed = true
+	}
+
+	return changed
+}
+
+// pruned forgets the objects removed by a prune request.
+func (s *ownershipStore) pruned(typ string, r authorization.Request) error {
+
+	var response struct {
+		ContainersDeleted []string
+		NetworksDeleted   []string
+		VolumesDeleted    []string
+	}
+	if err := json.Unmarshal(r.ResponseBody, &response); err != nil {
+		return err
+	}
+
+	refs := map[string][]string{
+		objectContainer: response.ContainersDeleted,
+		objectNetwork:   response.NetworksDeleted,
+		objectVolume:    response.VolumesDeleted,
+	}[typ]
+
+	changed := false
+	for _, ref := range refs {
+		if id, record := s.lookup(typ, ref); record != nil {
+			delete(s.objects, id)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return s.save()
+}
+
+// inspected learns the names of tracked containers and networks from the
+// responses listing or inspecting them, including the names the daemon
+// generated for containers created without one.
+func (s *ownershipStore) inspected(typ string, list bool, r authorization.Request) error {
+
+	if typ == objectVolume || len(r.ResponseBody) == 0 {
+		return nil
+	}
+
+	type object struct {
+		ID    string `json:"Id"`
+		Name  string
+		Names []string
+	}
+	var objects []object
+	if list {
+		if err := json.Unmarshal(r.ResponseBody, &objects); err != nil {
+			return err
+		}
+	} else {
+		var o object
+		if err := json.Unmarshal(r.ResponseBody, &o); err != nil {
+			return err
+		}
+		objects = []object{o}
+	}
+
+	changed := false
+	for _, o := range objects {
+		if record, ok := s.objects[o.ID]; !ok || record.Type != typ {
+			continue
+		}
+		var names []string
+		for _, name := range append(o.Names, o.Name) {
+			// Containers are listed with the names of their links too, like
+			// /web/db, which are not names of theirs.
+			name = strings.TrimPrefix(name, "/")
+			if name != "" && !strings.Contains(name, "/") && !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 && s.name(typ, o.ID, names) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return s.save()
+}
+
+// ownerPrincipal returns the principal recorded as the owner of the objects
+// created by an identity. Objects created by unverified identities, whose
+// names could be chosen to claim objects for another principal, are recorded
+// without an owner.
+func ownerPrincipal(identity Identity) string {
+
+	if !identity.Verified {
+		return ""
+	}
+
+	return identity.Name
+}
+
+// created records a created object, releasing its name from other records.
+// Objects created by anonymous principals are recorded without an owner.
+func (s *ownershipStore) created(typ string, r authorization.Request, owner string) error {
+
+	var response struct {
+		ID   string `json:"Id"`
+		Name string
+	}
+	if err := json.Unmarshal(r.ResponseBody, &response); err != nil {
+		return err
+	}
+
+	record := &ownerRecord{Type: typ, Owner: owner, Created: time.Now().UTC()}
+
+	id := response.ID
+	switch typ {
+	case objectContainer:
+		if u, err := url.Parse(r.RequestURI); err == nil && u.Query().Get("name") != "" {
+			record.Names = []string{strings.TrimPrefix(u.Query().Get("name"), "/")}
+		}
+	case objectNetwork:
+		var body struct{ Name string }
+		if err := json.Unmarshal(r.RequestBody, &body); err == nil && body.Name != "" {
+			record.Names = []string{body.Name}
+		}
+	case objectVolume:
+		id = response.Name
+	}
+
+	if id == "" {
+		return nil
+	}
+
+	names := record.Names
+	record.Names = nil
+	s.objects[id] = record
+	s.name(typ, id, names)
+
+	return s.save()
+}
+
+// save persists the records. The caller must hold the lock.
+func (s *ownershipStore) save() error {
+
+	bs, err := json.MarshalIndent(s.objects, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.file, bs)
+}
+
+// writeFileAtomic replaces the contents of a file, such that readers see
+// either the old or the new contents.
+func writeFileAtomic(path string, bs []byte) error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bs); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestParseRoute(t *testing.T) {
+	tests := []struct {
+		uri      string
+		expected apiRoute
+	}{
+		{"/v1.47/containers/json?all=1", apiRoute{Collection: "containers", Type: objectContainer, Action: "json"}},
+		{"/v1.47/containers/create?name=web", apiRoute{Collection: "containers", Type: objectContainer, Action: "create"}},
+		{"/v1.47/containers/web", apiRoute{Collection: "containers", Type: objectContainer, Ref: "web"}},
+		{"/containers/web/stop?t=10", apiRoute{Collection: "containers", Type: objectContainer, Ref: "web", Action: "stop"}},
+		{"/v1.47/volumes/data%20set", apiRoute{Collection: "volumes", Type: objectVolume, Ref: "data set"}},
+		{"/v1.47/networks/prune", apiRoute{Collection: "networks", Type: objectNetwork, Action: "prune"}},
+		{"/v1.47/images/json", apiRoute{Collection: "images", Action: "json"}},
+		{"/_ping", apiRoute{Collection: "_ping"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			if got := parseRoute(tc.uri); got != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestOwnershipStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "owners.json")
+	store, err := loadOwnershipStore(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	observe := func(owner string, r authorization.Request) {
+		t.Helper()
+		if r.ResponseStatusCode == 0 {
+			r.ResponseStatusCode = 200
+		}
+		if err := store.observe(r, func() string { return owner }); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	owner := func(uri string) string {
+		t.Helper()
+		target, ok := store.target(uri)
+		if !ok {
+			t.Fatalf("Expected %s to refer to an object", uri)
+		}
+		return target.Owner
+	}
+
+	observe("alice", authorization.Request{
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.47/containers/create?name=web",
+		ResponseStatusCode: 201,
+		ResponseBody:       []byte(`{"Id": "4fa6e0f0c678", "Warnings": []}`),
+	})
+	observe("bob", authorization.Request{
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.47/containers/create",
+		ResponseStatusCode: 201,
+		ResponseBody:       []byte(`{"Id": "4fb7d9a1e2f3", "Warnings": []}`),
+	})
+	observe("bob", authorization.Request{
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.47/containers/create?name=denied",
+		ResponseStatusCode: 409,
+		ResponseBody:       []byte(`{"message": "Conflict"}`),
+	})
+	observe("bob", authorization.Request{
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.47/networks/create",
+		RequestBody:        []byte(`{"Name": "backend"}`),
+		ResponseStatusCode: 201,
+		ResponseBody:       []byte(`{"Id": "22be93d5babb", "Warning": ""}`),
+	})
+	observe("carol", authorization.Request{
+		RequestMethod:      "POST",
+		RequestURI:         "/v1.47/volumes/create",
+		ResponseStatusCode: 201,
+		ResponseBody:       []byte(`{"Name": "data", "Driver": "local"}`),
+	})
+
+	for uri, expected := range map[string]string{
+		"/v1.47/containers/4fa6e0f0c678/json": "alice",
+		"/v1.47/containers/web/stop":          "alice",
+		"/v1.47/containers/4fa6/stop":         "alice",
+		"/v1.47/containers/4fb7/stop":         "bob",
+		"/v1.47/containers/4f/stop":           "",
+		"/v1.47/containers/denied/stop":       "",
+		"/v1.47/networks/backend":             "bob",
+		"/v1.47/volumes/data":                 "carol",
+		"/v1.47/volumes/web":                  "",
+	} {
+		if got := owner(uri); got != expected {
+			t.Errorf("Expected owner of %s to be %q, got %q", uri, expected, got)
+		}
+	}
+
+	observe("alice", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/web/rename?name=api"})
+	if got := owner("/v1.47/containers/api/json"); got != "alice" {
+		t.Errorf("Expected renamed container to be owned by alice, got %q", got)
+	}
+	if got := owner("/v1.47/containers/web/json"); got != "" {
+		t.Errorf("Expected old name to be forgotten, got %q", got)
+	}
+
+	observe("bob", authorization.Request{RequestMethod: "DELETE", RequestURI: "/v1.47/containers/4fb7d9a1e2f3?force=1", ResponseStatusCode: 204})
+	if got := owner("/v1.47/containers/4fb7d9a1e2f3/json"); got != "" {
+		t.Errorf("Expected removed container to be forgotten, got %q", got)
+	}
+
+	reloaded, err := loadOwnershipStore(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(reloaded.objects) != 3 {
+		t.Errorf("Expected 3 persisted objects, got %v", reloaded.objects)
+	}
+	if target, _ := reloaded.target("/v1.47/containers/api/json"); target.Owner != "alice" || target.ID != "4fa6e0f0c678" {
+		t.Errorf("Expected persisted container owned by alice, got %+v", target)
+	}
+}
+
+func TestEvaluateOwnership(t *testing.T) {
+	store, err := loadOwnershipStore(filepath.Join(t.TempDir(), "owners.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/ownership.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		owners:     store,
+	}
+	// Principals prefixed with "header:" are asserted through the unverified
+	// header source.
+	request := func(user, method, uri string) authorization.Request {
+		if name, ok := strings.CutPrefix(user, "header:"); ok {
+			return authorization.Request{RequestMethod: method, RequestURI: uri, RequestHeaders: map[string]string{"Authz-User": name}}
+		}
+		return authorization.Request{RequestMethod: method, RequestURI: uri, User: user, UserAuthNMethod: "TLS"}
+	}
+
+	for user, body := range map[string]string{"alice": `{"Id": "4fa6e0f0c678"}`, "header:bob": `{"Id": "9c3e1a2b4d5f"}`} {
+		created := request(user, "POST", "/v1.47/containers/create?name="+strings.TrimPrefix(user, "header:"))
+		created.ResponseStatusCode = 201
+		created.ResponseBody = []byte(body)
+		if res := plugin.AuthZRes(created); !res.Allow {
+			t.Fatalf("Expected response to be allowed, got %+v", res)
+		}
+	}
+	if target, _ := store.target("/v1.47/containers/bob/json"); target.ID != "9c3e1a2b4d5f" || target.Owner != "" {
+		t.Errorf("Expected container created by an unverified principal to have no owner, got %+v", target)
+	}
+
+	tests := []struct {
+		user    string
+		method  string
+		uri     string
+		allowed bool
+	}{
+		{"alice", "POST", "/v1.47/containers/alice/stop", true},
+		{"bob", "POST", "/v1.47/containers/alice/stop", false},
+		{"header:alice", "POST", "/v1.47/containers/alice/stop", false},
+		{"header:carol", "POST", "/v1.47/containers/bob/stop", true},
+		{"bob", "DELETE", "/v1.47/containers/4fa6e0f0c678", false},
+		{"bob", "POST", "/v1.47/containers/untracked/stop", true},
+		{"bob", "GET", "/v1.47/containers/json", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.user+" "+tc.method+" "+tc.uri, func(t *testing.T) {
+			allowed, err := plugin.evaluate(context.Background(), request(tc.user, tc.method, tc.uri))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if allowed != tc.allowed {
+				t.Errorf("Expected allowed: %v, got %v", tc.allowed, allowed)
+			}
+		})
+	}
+}
+
+func TestOwnershipStoreNames(t *testing.T) {
+	store, err := loadOwnershipStore(filepath.Join(t.TempDir(), "owners.json"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	observe := func(owner string, r authorization.Request) {
+		t.Helper()
+		if r.ResponseStatusCode == 0 {
+			r.ResponseStatusCode = 200
+		}
+		if err := store.observe(r, func() string { return owner }); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	owner := func(uri string) string {
+		t.Helper()
+		target, _ := store.target(uri)
+		return target.Owner
+	}
+
+	// Containers created without a name are found by their generated name
+	// once it was listed or inspected.
+	observe("alice", authorization.Request{
+		RequestMethod: "POST", RequestURI: "/v1.47/containers/create", ResponseStatusCode: 201,
+		ResponseBody: []byte(`{"Id": "4fa6e0f0c678", "Warnings": []}`),
+	})
+	observe("bob", authorization.Request{
+		RequestMethod: "POST", RequestURI: "/v1.47/containers/create", ResponseStatusCode: 201,
+		ResponseBody: []byte(`{"Id": "9b1c2d3e4f50", "Warnings": []}`),
+	})
+	if got := owner("/v1.47/containers/quirky_turing/stop"); got != "" {
+		t.Errorf("Expected unknown generated name to have no owner, got %q", got)
+	}
+	observe("carol", authorization.Request{
+		RequestMethod: "GET", RequestURI: "/v1.47/containers/json",
+		ResponseBody: []byte(`[{"Id": "4fa6e0f0c678", "Names": ["/quirky_turing", "/web/db"]}, {"Id": "0123456789ab", "Names": ["/untracked"]}]`),
+	})
+	observe("carol", authorization.Request{
+		RequestMethod: "GET", RequestURI: "/v1.47/containers/9b1c/json",
+		ResponseBody: []byte(`{"Id": "9b1c2d3e4f50", "Name": "/eager_hopper"}`),
+	})
+	for uri, expected := range map[string]string{
+		"/v1.47/containers/quirky_turing/stop": "alice",
+		"/v1.47/containers/eager_hopper/stop":  "bob",
+		"/v1.47/containers/web/db/stop":        "",
+		"/v1.47/containers/untracked/stop":     "",
+	} {
+		if got := owner(uri); got != expected {
+			t.Errorf("Expected owner of %s to be %q, got %q", uri, expected, got)
+		}
+	}
+
+	// A container removed by the daemon, as with --rm, gives up its name to
+	// the container created with it next.
+	observe("bob", authorization.Request{
+		RequestMethod: "POST", RequestURI: "/v1.47/containers/create?name=quirky_turing", ResponseStatusCode: 201,
+		ResponseBody: []byte(`{"Id": "7e8f9a0b1c2d", "Warnings": []}`),
+	})
+	if got := owner("/v1.47/containers/quirky_turing/stop"); got != "bob" {
+		t.Errorf("Expected reused name to be owned by bob, got %q", got)
+	}
+	if got := owner("/v1.47/containers/4fa6e0f0c678/stop"); got != "alice" {
+		t.Errorf("Expected replaced container to keep its owner by ID, got %q", got)
+	}
+	observe("bob", authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/9b1c2d3e4f50/rename?name=quirky_turing"})
+	if id, _ := store.lookup(objectContainer, "quirky_turing"); id != "9b1c2d3e4f50" {
+		t.Errorf("Expected renamed container to take the name, got %q", id)
+	}
+
+	// Removed and pruned objects are forgotten.
+	observe("bob", authorization.Request{RequestMethod: "DELETE", RequestURI: "/v1.47/containers/quirky_turing", ResponseStatusCode: 204})
+	if _, ok := store.objects["9b1c2d3e4f50"]; ok {
+		t.Errorf("Expected removed container to be forgotten")
+	}
+	observe("bob", authorization.Request{
+		RequestMethod: "POST", RequestURI: "/v1.47/networks/create", ResponseStatusCode: 201,
+		RequestBody: []byte(`{"Name": "backend"}`), ResponseBody: []byte(`{"Id": "22be93d5babb", "Warning": ""}`),
+	})
+	observe("bob", authorization.Request{
+		RequestMethod: "POST", RequestURI: "/v1.47/containers/prune",
+		ResponseBody: []byte(`{"ContainersDeleted": ["4fa6e0f0c678", "0123456789ab"], "SpaceReclaimed": 0}`),
+	})
+	observe("bob", authorization.Request{
+		RequestMethod: "POST", RequestURI: "/v1.47/networks/prune",
+		ResponseBody: []byte(`{"NetworksDeleted": ["backend"]}`),
+	})
+	if len(store.objects) != 1 || store.objects["7e8f9a0b1c2d"] == nil {
+		t.Errorf("Expected only the unpruned container to be tracked, got %v", store.objects)
+	}
+}
+
+func TestOwnershipStoreLookupDeterministic(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := &ownershipStore{objects: map[string]*ownerRecord{
+		"aaaa": {Type: objectContainer, Owner: "alice", Names: []string{"web"}, Created: created},
+		"bbbb": {Type: objectContainer, Owner: "bob", Names: []string{"web"}, Created: created.Add(time.Hour)},
+		"cccc": {Type: objectContainer, Owner: "carol", Names: []string{"api"}, Created: created},
+		"dddd": {Type: objectContainer, Owner: "dave", Names: []string{"api"}, Created: created},
+	}}
+
+	for i := 0; i < 20; i++ {
+		if id, _ := store.lookup(objectContainer, "web"); id != "bbbb" {
+			t.Fatalf("Expected the most recently created container, got %q", id)
+		}
+		if id, _ := store.lookup(objectContainer, "api"); id != "cccc" {
+			t.Fatalf("Expected the smallest ID among containers created together, got %q", id)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// peerCredentials is only supported on Linux.
+func peerCredentials(net.Conn) (*PeerCredentials, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/open-policy-agent/opa/v1/bundle"
+)
+
+// policyDirDebounce is how long the policy directory must be left unchanged
+// before it is loaded again, so files written in several steps are loaded
+// once.
+const policyDirDebounce = 250 * time.Millisecond
+
+// policyDir is a local bundle directory, holding a .manifest, policies and
+// data, which is loaded again whenever it changes. A change that does not
+// yield a valid bundle leaves the previously loaded bundle active.
+type policyDir struct {
+	path    string
+	name    string
+	compile compileOptions
+
+	mtx        sync.Mutex
+	loaded     *loadedBundle
+	lastReload time.Time
+	lastError  error
+}
+
+// loadPolicyDir loads the bundle in a directory. Failing to load it is not
+// an error: requests are handled according to the failure mode until the
+// directory holds a valid bundle. Bundles whose policies do not compile under
+// c are not valid.
+func loadPolicyDir(path string, c compileOptions) (*policyDir, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("policy directory %s is not a directory", path)
+	}
+
+	d := &policyDir{path: path, name: filepath.Base(filepath.Clean(path)), compile: c}
+	d.reload()
+
+	return d, nil
+}
+
+// reload loads the bundle in the directory again, activating it if it is
+// valid and changed.
+func (d *policyDir) reload() {
+
+	lb, err := d.read()
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if err != nil {
+		d.lastError = err
+		log.Printf("Failed loading policy directory %s, keeping the active policy: %v", d.path, err)
+		return
+	}
+	d.lastError = nil
+
+	if d.loaded != nil && d.loaded.hash == lb.hash {
+		return
+	}
+	d.loaded = lb
+	d.lastReload = time.Now().UTC()
+	log.Printf("Activated policy directory %s at revision %s.", d.path, lb.revision)
+}
+
+func (d *policyDir) read() (*loadedBundle, error) {
+
+	fsys := os.DirFS(d.path)
+
+	loader, err := bundle.NewFSLoader(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading the bundle validates that its policies and data are within the
+	// roots of its manifest.
+	b, err := d.compile.bundleReader(bundle.NewCustomReader(loader)).Read()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.compile.compile(b.ParsedModules(d.name)); err != nil {
+		return nil, err
+	}
+
+	hash, err := hashFS(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLoadedBundle(d.name, &b, hash), nil
+}
+
+// Policy returns the active bundle, or an error if none was loaded yet.
+func (d *policyDir) Policy(context.Context) (policyVersion, error) {
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.loaded == nil {
+		return policyVersion{}, fmt.Errorf("policy directory %s not loaded: %w", d.path, d.lastError)
+	}
+
+	return d.loaded.policy(d.compile), nil
+}
+
+// watch reloads the directory whenever a file in it, or in one of its
+// subdirectories, changes, until ctx is done.
+func (d *policyDir) watch(ctx context.Context) error {
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := d.watchTree(w, d.path); err != nil {
+		return err
+	}
+
+	debounce := time.NewTimer(0)
+	if !debounce.Stop() {
+		<-debounce.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := d.watchTree(w, event.Name); err != nil {
+						log.Printf("Failed watching %s: %v", event.Name, err)
+					}
+				}
+			}
+			debounce.Reset(policyDirDebounce)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("Failed watching policy directory %s: %v", d.path, err)
+		case <-debounce.C:
+			d.reload()
+		}
+	}
+}
+
+// watchTree adds a directory and its subdirectories to the watcher.
+func (d *policyDir) watchTree(w *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return w.Add(path)
+		}
+		return nil
+	})
+}
+
+// Health reports the directory as ready once a bundle was loaded from it.
+func (d *policyDir) Health() Health {
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	health := Health{Ready: d.loaded != nil}
+	if d.loaded != nil {
+		health.Revision = d.loaded.revision
+		reload := d.lastReload
+		health.LastReload = &reload
+	}
+	if d.lastError != nil {
+		health.LastError = d.lastError.Error()
+	}
+
+	return health
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func writePolicyDir(t *testing.T, dir, manifest, policy string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, ".manifest"), []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "docker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker", "policy.rego"), []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthZReqPolicyDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "authz")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writePolicyDir(t, dir, `{"revision": "r1", "roots": ["docker"]}`, "package docker.authz\n\nallow if input.Method == \"GET\"\n")
+
+	d, err := loadPolicyDir(dir, compileOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = d.watch(ctx) }()
+
+	plugin := DockerAuthZPlugin{
+		policyDir:   d,
+		allowPath:   "data.docker.authz.allow",
+		quiet:       true,
+		mode:        modeEnforce,
+		failureMode: failClosed,
+	}
+	post := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}
+
+	response := plugin.AuthZReq(post)
+	if response.Allow || response.Msg != defaultDenyMessage+" [policy authz@r1]" {
+		t.Errorf("Expected POST to be denied, got %+v", response)
+	}
+
+	waitFor := func(cond func(Health) bool) Health {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			h := d.Health()
+			if cond(h) {
+				return h
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for the policy directory, got %+v", h)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// Give the watcher time to watch the directory.
+	time.Sleep(100 * time.Millisecond)
+
+	writePolicyDir(t, dir, `{"revision": "r2", "roots": ["docker"]}`, "package docker.authz\n\nallow := true\n")
+	waitFor(func(h Health) bool { return h.Revision == "authz@r2" })
+	if response := plugin.AuthZReq(post); !response.Allow {
+		t.Errorf("Expected POST to be allowed after reload, got %+v", response)
+	}
+
+	// Policies outside the roots of the manifest are refused, keeping the
+	// active policy.
+	writePolicyDir(t, dir, `{"revision": "r3", "roots": ["other"]}`, "package docker.authz\n\nallow := false\n")
+	h := waitFor(func(h Health) bool { return h.LastError != "" })
+	if !h.Ready || h.Revision != "authz@r2" || !strings.Contains(h.LastError, "root") {
+		t.Errorf("Expected previous revision to remain active, got %+v", h)
+	}
+	if response := plugin.AuthZReq(post); !response.Allow {
+		t.Errorf("Expected previous policy to remain active, got %+v", response)
+	}
+
+	// New subdirectories are watched.
+	writePolicyDir(t, dir, `{"revision": "r4", "roots": ["docker"]}`, "package docker.authz\n\nallow := true\n")
+	h = waitFor(func(h Health) bool { return h.Revision == "authz@r4" && h.LastError == "" })
+	if err := os.MkdirAll(filepath.Join(dir, "docker", "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(dir, "docker", "lib", "lib.rego"), []byte("package docker.lib\n\nadmin := \"alice\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func(next Health) bool { return next.LastReload.After(*h.LastReload) })
+}
+
+func TestLoadPolicyDirInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writePolicyDir(t, dir, `{"revision": "r1", "roots": ["other"]}`, "package docker.authz\n\nallow := true\n")
+
+	d, err := loadPolicyDir(dir, compileOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	plugin := DockerAuthZPlugin{policyDir: d, allowPath: "data.docker.authz.allow", quiet: true, mode: modeEnforce, failureMode: failClosed}
+	if response := plugin.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/containers/json"}); response.Allow || response.Err == "" {
+		t.Errorf("Expected request to fail without a valid bundle, got %+v", response)
+	}
+	if h := d.Health(); h.Ready || h.LastError == "" {
+		t.Errorf("Expected directory not to be ready, got %+v", h)
+	}
+
+	if _, err := loadPolicyDir(filepath.Join(dir, ".manifest"), compileOptions{}); err == nil {
+		t.Errorf("Expected error loading a file as a policy directory")
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+// maxProxyBodySize is the largest JSON request body passed to the policy,
+// matching the limit applied by the Docker daemon to authorization plugins.
+const maxProxyBodySize = 1 << 20
+
+// proxyConfig configures the optional proxy in front of the Docker API
+// socket, which authorizes requests using the credentials of the local
+// process that connected to it.
+type proxyConfig struct {
+	pluginName string
+
+	// addr is the unix:///path/to/socket clients connect to.
+	addr string
+
+	// upstream is the unix:///path or tcp://host:port of the Docker API.
+	upstream string
+}
+
+// proxyRequestKey carries the authorization.Request of a forwarded request
+// to the authorization of its response.
+type proxyRequestKey struct{}
+
+// dockerProxy forwards the Docker API requests allowed by the plugin to the
+// Docker daemon.
+type dockerProxy struct {
+	plugin     DockerAuthZPlugin
+	pluginName string
+	upstream   *httputil.ReverseProxy
+}
+
+func newDockerProxy(p DockerAuthZPlugin, pluginName, upstream string) (*dockerProxy, error) {
+
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	target := &url.URL{Scheme: "http"}
+
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		target.Host = "docker"
+	case "tcp":
+		target.Host = u.Host
+	default:
+		return nil, fmt.Errorf("invalid upstream address %q, expected unix:///path or tcp://host:port", upstream)
+	}
+
+	dp := &dockerProxy{
+		plugin:     p,
+		pluginName: pluginName,
+	}
+	dp.upstream = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+		},
+		Transport: transport,
+		// Stream logs, events and attached output as they arrive.
+		FlushInterval:  -1,
+		ModifyResponse: dp.authorizeResponse,
+	}
+
+	return dp, nil
+}
+
+// ServeHTTP authorizes the request with the plugin, and forwards it to the
+// Docker daemon if allowed. Denied requests are answered like the Docker
+// daemon answers requests denied by an authorization plugin.
+func (dp *dockerProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	req := authorization.Request{
+		RequestMethod:  r.Method,
+		RequestURI:     r.URL.RequestURI(),
+		RequestHeaders: map[string]string{},
+	}
+	for k := range r.Header {
+		req.RequestHeaders[k] = r.Header.Get(k)
+	}
+
+	if isJSON(r.Header.Get("Content-Type")) && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxProxyBodySize+1))
+		if err != nil {
+			writeProxyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(body) <= maxProxyBodySize {
+			req.RequestBody = body
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+
+	res := dp.plugin.authorize(r.Context(), req)
+
+	if res.Err != "" {
+		writeProxyError(w, http.StatusInternalServerError, fmt.Sprintf("plugin %s failed with error: %s", dp.pluginName, res.Err))
+		return
+	}
+	if !res.Allow {
+		writeProxyError(w, http.StatusForbidden, fmt.Sprintf("authorization denied by plugin %s: %s", dp.pluginName, res.Msg))
+		return
+	}
+
+	dp.upstream.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyRequestKey{}, req)))
+
+	// Streamed responses, like those of attached execs, end once forwarded.
+	dp.plugin.usage.release(req)
+}
+
+// authorizeResponse passes JSON responses of a known size to the plugin, like
+// the Docker daemon does before returning them. Streamed responses are
+// forwarded as they are.
+func (dp *dockerProxy) authorizeResponse(resp *http.Response) error {
+
+	if !isJSON(resp.Header.Get("Content-Type")) || resp.ContentLength < 0 || resp.ContentLength > maxProxyBodySize {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	req, ok := resp.Request.Context().Value(proxyRequestKey{}).(authorization.Request)
+	if !ok {
+		return nil
+	}
+	req.ResponseStatusCode = resp.StatusCode
+	req.ResponseHeaders = map[string]string{}
+	req.ResponseBody = body
+	for k := range resp.Header {
+		req.ResponseHeaders[k] = resp.Header.Get(k)
+	}
+
+	res := dp.plugin.authorizeResponse(resp.Request.Context(), req)
+	if !res.Allow {
+		return fmt.Errorf("authorization denied by plugin %s: %s", dp.pluginName, res.Msg)
+	}
+
+	return nil
+}
+
+func writeProxyError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
+
+// serve serves the proxy until its listener fails. The credentials of each
+// connecting process are attached to the context of its requests.
+func (c proxyConfig) serve(p DockerAuthZPlugin) error {
+
+	u, err := url.Parse(c.addr)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "unix" {
+		return fmt.Errorf("invalid proxy address %q, expected unix:///path", c.addr)
+	}
+
+	dp, err := newDockerProxy(p, c.pluginName, c.upstream)
+	if err != nil {
+		return err
+	}
+
+	l, err := listenUnix(u.Path)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler: dp,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			peer, err := peerCredentials(conn)
+			if err != nil {
+				log.Printf("Failed reading peer credentials, treating client as anonymous: %v", err)
+				return ctx
+			}
+			return withPeer(ctx, peer)
+		},
+	}
+
+	log.Printf("Proxying the Docker API from %s to %s.", c.addr, c.upstream)
+	return server.Serve(l)
+}
@@ -0,0 +1,199 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startProxy serves the plugin's Docker API proxy in front of a fake Docker
+// daemon, returning a client connected to the proxy.
+func startProxy(t *testing.T, plugin DockerAuthZPlugin, daemon http.Handler) *http.Client {
+	dir := t.TempDir()
+
+	upstreamSocket := filepath.Join(dir, "docker.sock")
+	upstream, err := net.Listen("unix", upstreamSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstream.Close() })
+	go func() { _ = http.Serve(upstream, daemon) }()
+
+	proxySocket := filepath.Join(dir, "authz.sock")
+	config := proxyConfig{pluginName: "authz", addr: "unix://" + proxySocket, upstream: "unix://" + upstreamSocket}
+	go func() { _ = config.serve(plugin) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(proxySocket); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", proxySocket)
+		},
+	}}
+}
+
+func TestProxyPeerCredentials(t *testing.T) {
+	// Only the current user may create containers, and only through the proxy.
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	policy := fmt.Sprintf(`package docker.authz
+
+default allow := false
+
+allow if input.Method == "GET"
+
+allow if {
+	input.Identity.Source == "peercred"
+	input.Identity.Verified
+	input.Identity.Peer.UID == %d
+	input.Body.Image == "busybox"
+}
+`, os.Getuid())
+	if err := os.WriteFile(policyFile, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte(policy))
+	plugin := DockerAuthZPlugin{policyFile: policyFile, allowPath: "data.docker.authz.allow", quiet: true}
+
+	// A fake Docker daemon echoing the requests it receives.
+	client := startProxy(t, plugin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	}))
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "allowed for the connecting user",
+			body:           `{"Image": "busybox"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `POST /v1.47/containers/create?name=test {"Image": "busybox"}`,
+		},
+		{
+			name:           "denied by policy",
+			body:           `{"Image": "alpine"}`,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "authorization denied by plugin authz: request rejected by administrative policy [policy " + policyFileRevision(hex.EncodeToString(digest[:])) + "]",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := client.Post("http://docker/v1.47/containers/create?name=test", "application/json", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				var msg map[string]string
+				if err := json.Unmarshal(body, &msg); err != nil {
+					t.Fatalf("Improper JSON error - got %v", err)
+				}
+				body = []byte(msg["message"])
+			}
+			if string(body) != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestProxyRecordsOwnership(t *testing.T) {
+	store, err := loadOwnershipStore(filepath.Join(t.TempDir(), "owners.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := DockerAuthZPlugin{policyFile: "testdata/ownership.rego", allowPath: "data.docker.authz.allow", quiet: true, owners: store}
+
+	client := startProxy(t, plugin, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Id": "4fa6e0f0c678", "Warnings": []}`)
+	}))
+
+	resp, err := client.Post("http://docker/v1.47/containers/create?name=web", "application/json", strings.NewReader(`{"Image": "busybox"}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || !strings.Contains(string(body), "4fa6e0f0c678") {
+		t.Fatalf("Expected response to be forwarded, got %d %s", resp.StatusCode, body)
+	}
+
+	expected, _ := resolvePeer(withPeer(context.Background(), &PeerCredentials{UID: os.Getuid(), GID: os.Getgid()}))
+	if target, _ := store.target("/v1.47/containers/web/json"); target.Owner != expected.Name {
+		t.Errorf("Expected container owned by %q, got %+v", expected.Name, target)
+	}
+}
+
+func TestProxyJSONMediaType(t *testing.T) {
+	policyFile := filepath.Join(t.TempDir(), "policy.rego")
+	policy := `package docker.authz
+
+default allow := false
+
+allow if {
+	input.Body.Image == "busybox"
+	not input.Body.HostConfig.Privileged
+}
+`
+	if err := os.WriteFile(policyFile, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	plugin := DockerAuthZPlugin{policyFile: policyFile, allowPath: "data.docker.authz.allow", quiet: true}
+
+	client := startProxy(t, plugin, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	tests := []struct {
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{"application/json; charset=utf-8", `{"Image": "busybox"}`, http.StatusCreated},
+		{"application/json; charset=utf-8", `{"Image": "busybox", "HostConfig": {"Privileged": true}}`, http.StatusForbidden},
+		{"Application/JSON", `{"Image": "busybox", "HostConfig": {"Privileged": true}}`, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		resp, err := client.Post("http://docker/v1.47/containers/create", tc.contentType, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.expectedStatus {
+			t.Errorf("%s %s: expected status %d, got %d", tc.contentType, tc.body, tc.expectedStatus, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Types of the Docker objects requests can refer to.
+const (
+	objectContainer = "container"
+	objectVolume    = "volume"
+	objectNetwork   = "network"
+)
+
+// objectCollections maps the collections of the Docker API to the type of
+// the objects they hold.
+var objectCollections = map[string]string{
+	"containers": objectContainer,
+	"volumes":    objectVolume,
+	"networks":   objectNetwork,
+}
+
+// collectionActions are the path segments following a collection that act on
+// the collection rather than on an object.
+var collectionActions = map[string]bool{
+	"json":   true,
+	"create": true,
+	"prune":  true,
+}
+
+// apiRoute is the path of a Docker API request, split into the collection,
+// the object in that collection and the action on it. For example,
+// /v1.47/containers/web/stop is the stop action on the container web, and
+// /v1.47/containers/create the create action on the containers collection.
+type apiRoute struct {
+	Collection string
+	Type       string
+	Ref        string
+	Action     string
+}
+
+// parseRoute splits the path of a request URI into its route.
+func parseRoute(uri string) apiRoute {
+
+	parts := strings.Split(strings.TrimPrefix(apiPath(uri), "/"), "/")
+
+	route := apiRoute{Collection: parts[0], Type: objectCollections[parts[0]]}
+	if len(parts) < 2 {
+		return route
+	}
+
+	if collectionActions[parts[1]] || route.Type == "" {
+		route.Action = strings.Join(parts[1:], "/")
+		return route
+	}
+
+	ref, err := url.PathUnescape(parts[1])
+	if err != nil {
+		ref = parts[1]
+	}
+	route.Ref = ref
+	route.Action = strings.Join(parts[2:], "/")
+
+	return route
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/util"
+)
+
+// routeSpec is the definition of a route in the routes file.
+type routeSpec struct {
+	Methods    []string `json:"methods"`
+	Path       string   `json:"path"`
+	Entrypoint string   `json:"entrypoint"`
+}
+
+// decisionRoute sends requests with one of the methods, or any method if
+// none is given, and an API path (without the version prefix) matching the
+// glob to the allow decision at entrypoint.
+type decisionRoute struct {
+	methods    map[string]bool
+	path       glob.Glob
+	entrypoint string
+}
+
+// routingTable maps Docker API requests to the policy entrypoint deciding
+// them. A nil *routingTable sends every request to the default entrypoint.
+type routingTable struct {
+	routes []decisionRoute
+}
+
+// loadRoutingTable loads the routes defined in a YAML or JSON file, e.g.
+// {"routes": [{"path": "/containers/**", "entrypoint": "docker/authz/containers/allow"}]}.
+// Routes are matched in order.
+func loadRoutingTable(file string) (*routingTable, error) {
+
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Routes []routeSpec `json:"routes"`
+	}
+	if err := util.Unmarshal(bs, &doc); err != nil {
+		return nil, fmt.Errorf("invalid routes file %s: %w", file, err)
+	}
+
+	t := &routingTable{}
+	for i, spec := range doc.Routes {
+		route, err := newDecisionRoute(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %d in %s: %w", i, file, err)
+		}
+		t.routes = append(t.routes, route)
+	}
+
+	return t, nil
+}
+
+func newDecisionRoute(spec routeSpec) (decisionRoute, error) {
+
+	if !strings.HasPrefix(spec.Path, "/") {
+		return decisionRoute{}, fmt.Errorf("path %q must start with /", spec.Path)
+	}
+	g, err := glob.Compile(spec.Path, '/')
+	if err != nil {
+		return decisionRoute{}, fmt.Errorf("invalid path %q: %w", spec.Path, err)
+	}
+
+	entrypoint, err := parseEntrypoint(spec.Entrypoint)
+	if err != nil {
+		return decisionRoute{}, err
+	}
+
+	route := decisionRoute{path: g, entrypoint: entrypoint}
+	if len(spec.Methods) > 0 {
+		route.methods = map[string]bool{}
+		for _, method := range spec.Methods {
+			route.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	return route, nil
+}
+
+// parseEntrypoint returns the data.* reference of an entrypoint given either
+// as a reference (data.docker.authz.allow) or as a path (docker/authz/allow).
+func parseEntrypoint(entrypoint string) (string, error) {
+
+	query := entrypoint
+	if query != "data" && !strings.HasPrefix(query, "data.") {
+		query = "data." + strings.ReplaceAll(strings.Trim(query, "/"), "/", ".")
+	}
+
+	ref, err := ast.ParseRef(query)
+	if err != nil || len(ref) < 2 || !ref.IsGround() {
+		return "", fmt.Errorf("invalid entrypoint %q", entrypoint)
+	}
+
+	return query, nil
+}
+
+// entrypoint returns the entrypoint of the first route matching the request,
+// or fallback if none does.
+func (t *routingTable) entrypoint(method, uri, fallback string) string {
+
+	if t == nil {
+		return fallback
+	}
+
+	path := apiPath(uri)
+	for _, route := range t.routes {
+		if (route.methods == nil || route.methods[method]) && route.path.Match(path) {
+			return route.entrypoint
+		}
+	}
+
+	return fallback
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestLoadRoutingTable(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		note    string
+		routes  string
+		wantErr bool
+	}{
+		{note: "valid", routes: `{"routes": [{"methods": ["post"], "path": "/containers/**", "entrypoint": "docker/authz/containers/allow"}]}`},
+		{note: "yaml", routes: "routes:\n- path: /images/**\n  entrypoint: data.docker.authz.images.allow\n"},
+		{note: "relative path", routes: `{"routes": [{"path": "containers/**", "entrypoint": "docker/authz/allow"}]}`, wantErr: true},
+		{note: "invalid glob", routes: `{"routes": [{"path": "/containers/[", "entrypoint": "docker/authz/allow"}]}`, wantErr: true},
+		{note: "missing entrypoint", routes: `{"routes": [{"path": "/containers/**"}]}`, wantErr: true},
+		{note: "invalid entrypoint", routes: `{"routes": [{"path": "/containers/**", "entrypoint": "docker/authz/al low"}]}`, wantErr: true},
+		{note: "invalid file", routes: `{"routes": {}}`, wantErr: true},
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			file := filepath.Join(dir, "routes"+string(rune('a'+i))+".yaml")
+			if err := os.WriteFile(file, []byte(tc.routes), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadRoutingTable(file)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRoutingTableEntrypoint(t *testing.T) {
+	var table *routingTable
+	if got := table.entrypoint("GET", "/v1.47/containers/json", "data.docker.authz.allow"); got != "data.docker.authz.allow" {
+		t.Errorf("Expected nil table to use the default entrypoint, got %v", got)
+	}
+
+	table = &routingTable{}
+	for _, spec := range []routeSpec{
+		{Methods: []string{"post"}, Path: "/containers/create", Entrypoint: "/docker/authz/create/allow"},
+		{Path: "/containers/**", Entrypoint: "docker/authz/containers/allow"},
+		{Path: "/images/**", Entrypoint: "data.docker.authz.images.allow"},
+	} {
+		route, err := newDecisionRoute(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table.routes = append(table.routes, route)
+	}
+
+	tests := []struct {
+		method   string
+		uri      string
+		expected string
+	}{
+		{"POST", "/v1.47/containers/create?name=web", "data.docker.authz.create.allow"},
+		{"GET", "/v1.47/containers/json", "data.docker.authz.containers.allow"},
+		{"POST", "/containers/web/stop", "data.docker.authz.containers.allow"},
+		{"POST", "/v1.47/images/create", "data.docker.authz.images.allow"},
+		{"POST", "/v1.47/volumes/create", "data.docker.authz.allow"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.method+" "+tc.uri, func(t *testing.T) {
+			if got := table.entrypoint(tc.method, tc.uri, "data.docker.authz.allow"); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAuthZReqRoutes(t *testing.T) {
+	policy := `package docker.authz
+
+default allow := false
+
+containers.allow if input.Method == "GET"
+
+images.allow := true
+`
+	routes := filepath.Join(t.TempDir(), "routes.yaml")
+	bs := "routes:\n- path: /containers/**\n  entrypoint: docker/authz/containers/allow\n- path: /images/**\n  entrypoint: docker/authz/images/allow\n- path: /networks/**\n  entrypoint: docker/authz/networks/allow\n"
+	if err := os.WriteFile(routes, []byte(bs), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	table, err := loadRoutingTable(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method        string
+		uri           string
+		expectedAllow bool
+	}{
+		{"GET", "/v1.47/containers/json", true},
+		{"POST", "/v1.47/containers/create", false},
+		{"POST", "/v1.47/images/create", true},
+		{"POST", "/v1.47/networks/create", false},
+		{"POST", "/v1.47/volumes/create", false},
+	}
+
+	for name, plugin := range paritySources(t, policy) {
+		plugin.routes = table
+		t.Run(name, func(t *testing.T) {
+			for _, tc := range tests {
+				response := plugin.AuthZReq(authorization.Request{RequestMethod: tc.method, RequestURI: tc.uri})
+				if response.Allow != tc.expectedAllow || response.Err != "" {
+					t.Errorf("%s %s: expected allow: %v, got %+v", tc.method, tc.uri, tc.expectedAllow, response)
+				}
+			}
+		})
+	}
+}
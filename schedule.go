@@ -0,0 +1,317 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// The plugin image has no time zone database of its own.
+	_ "time/tzdata"
+
+	"github.com/open-policy-agent/opa/v1/util"
+)
+
+// Time describes the schedule windows at the time of a request, exposed to
+// policy as input.Time.
+type Time struct {
+	// Active lists the names of the active windows, in name order.
+	Active  []string
+	Windows map[string]WindowState
+}
+
+// WindowState is the state of a schedule window. Start and End are only set
+// while the window is active.
+type WindowState struct {
+	Active bool
+	Start  string `json:",omitempty"`
+	End    string `json:",omitempty"`
+}
+
+// windowSpec is the definition of a window in the schedule file. Windows
+// either recur, opening at the times matched by a cron expression for the
+// given duration, or are open from start to end.
+type windowSpec struct {
+	Cron     string `json:"cron"`
+	Duration string `json:"duration"`
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+type window struct {
+	name     string
+	cron     *cronSchedule
+	duration time.Duration
+	start    time.Time
+	end      time.Time
+	location *time.Location
+}
+
+// schedule is a set of named time windows. A nil *schedule has no windows.
+type schedule struct {
+	windows []window
+}
+
+// loadSchedule loads the windows defined in a YAML or JSON file, e.g.
+// {"timezone": "Europe/Berlin", "windows": {"freeze": {"cron": "0 18 * * 5", "duration": "62h"}}}.
+func loadSchedule(file string) (*schedule, error) {
+
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Timezone string                `json:"timezone"`
+		Windows  map[string]windowSpec `json:"windows"`
+	}
+	if err := util.Unmarshal(bs, &doc); err != nil {
+		return nil, fmt.Errorf("invalid schedule file %s: %w", file, err)
+	}
+
+	s := &schedule{}
+	for name, spec := range doc.Windows {
+		if spec.Timezone == "" {
+			spec.Timezone = doc.Timezone
+		}
+		w, err := newWindow(name, spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid window %s in %s: %w", name, file, err)
+		}
+		s.windows = append(s.windows, w)
+	}
+	sort.Slice(s.windows, func(i, j int) bool { return s.windows[i].name < s.windows[j].name })
+
+	return s, nil
+}
+
+func newWindow(name string, spec windowSpec) (window, error) {
+
+	w := window{name: name, location: time.UTC}
+
+	if spec.Timezone != "" {
+		location, err := time.LoadLocation(spec.Timezone)
+		if err != nil {
+			return w, err
+		}
+		w.location = location
+	}
+
+	switch {
+	case spec.Cron != "" && spec.Start == "" && spec.End == "":
+		cron, err := parseCron(spec.Cron)
+		if err != nil {
+			return w, err
+		}
+		w.cron = cron
+		w.duration, err = time.ParseDuration(spec.Duration)
+		if err != nil {
+			return w, fmt.Errorf("invalid duration: %w", err)
+		}
+		if w.duration <= 0 {
+			return w, fmt.Errorf("duration must be positive")
+		}
+	case spec.Cron == "" && spec.Start != "" && spec.End != "":
+		var err error
+		if w.start, err = parseWindowTime(spec.Start, w.location); err != nil {
+			return w, err
+		}
+		if w.end, err = parseWindowTime(spec.End, w.location); err != nil {
+			return w, err
+		}
+		if !w.end.After(w.start) {
+			return w, fmt.Errorf("end must be after start")
+		}
+	default:
+		return w, fmt.Errorf("either cron and duration, or start and end are required")
+	}
+
+	return w, nil
+}
+
+// parseWindowTime parses an RFC 3339 time, or a local time without offset
+// like 2024-12-20T18:00 in the time zone of the window.
+func parseWindowTime(s string, location *time.Location) (time.Time, error) {
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, location); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// at returns the state of the windows at the given time.
+func (s *schedule) at(now time.Time) Time {
+
+	t := Time{Active: []string{}, Windows: map[string]WindowState{}}
+
+	for _, w := range s.windows {
+		var state WindowState
+		if start, end, ok := w.occurrence(now); ok {
+			state = WindowState{Active: true, Start: start.Format(time.RFC3339), End: end.Format(time.RFC3339)}
+			t.Active = append(t.Active, w.name)
+		}
+		t.Windows[w.name] = state
+	}
+
+	return t
+}
+
+// occurrence returns the occurrence of the window open at the given time,
+// if any. Of overlapping occurrences of a recurring window, the earliest one
+// is returned.
+func (w window) occurrence(now time.Time) (time.Time, time.Time, bool) {
+
+	if w.cron == nil {
+		return w.start, w.end, !now.Before(w.start) && now.Before(w.end)
+	}
+
+	start, ok := w.cron.earliest(now.In(w.location), w.duration)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+
+	return start, start.Add(w.duration), true
+}
+
+// cronSchedule is a standard five field cron expression: minute, hour, day
+// of month, month and day of week.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+
+	// Like cron, either the day of month or the day of week must match if
+	// both are restricted.
+	anyDay bool
+}
+
+var cronFieldRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(expr string) (*cronSchedule, error) {
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q, expected 5 fields", expr)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFieldRanges[i][0], cronFieldRanges[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+		}
+		sets[i] = set
+	}
+
+	// Sunday is both 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &cronSchedule{
+		minutes:  sets[0],
+		hours:    sets[1],
+		days:     sets[2],
+		months:   sets[3],
+		weekdays: sets[4],
+		anyDay:   !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps
+// like 1,5-10,*/15 into a bit set.
+func parseCronField(field string, minimum, maximum int) (uint64, error) {
+
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		expr, stepExpr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepExpr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+		}
+
+		lo, hi := minimum, maximum
+		if expr != "*" {
+			from, to, isRange := strings.Cut(expr, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if hasStep {
+				hi = maximum
+			}
+		}
+		if lo < minimum || hi > maximum || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, minimum, maximum)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+
+	return set, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+
+	day := c.days&(1<<t.Day()) != 0
+	weekday := c.weekdays&(1<<int(t.Weekday())) != 0
+
+	if c.anyDay {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// earliest returns the earliest time matched by the schedule in the window
+// of the given duration ending at now, i.e. the start of the earliest
+// occurrence still open at now.
+func (c *cronSchedule) earliest(now time.Time, duration time.Duration) (time.Time, bool) {
+
+	from := now.Add(-duration).Truncate(time.Minute)
+	if !from.After(now.Add(-duration)) {
+		from = from.Add(time.Minute)
+	}
+
+	for t := from; !t.After(now); {
+		if c.months&(1<<int(t.Month())) == 0 || !c.matchesDay(t) {
+			y, m, d := t.Date()
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hours&(1<<t.Hour()) == 0 {
+			y, m, d := t.Date()
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.minutes&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
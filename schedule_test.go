@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		time    string
+		matches bool
+	}{
+		{"* * * * *", "2024-06-07T10:11:00Z", true},
+		{"*/15 9-17 * * 1-5", "2024-06-07T10:45:00Z", true},
+		{"*/15 9-17 * * 1-5", "2024-06-07T10:46:00Z", false},
+		{"*/15 9-17 * * 1-5", "2024-06-08T10:45:00Z", false},
+		{"0 0 1,15 * *", "2024-06-15T00:00:00Z", true},
+		{"0 0 * * 7", "2024-06-09T00:00:00Z", true},
+		{"0 0 * 12 0", "2024-06-09T00:00:00Z", false},
+		// Day of month or day of week, as both are restricted.
+		{"0 0 13 * 5", "2024-06-07T00:00:00Z", true},
+		{"0 0 13 * 5", "2024-06-13T00:00:00Z", true},
+		{"0 0 13 * 5", "2024-06-12T00:00:00Z", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.expr+" "+tc.time, func(t *testing.T) {
+			cron, err := parseCron(tc.expr)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			now, _ := time.Parse(time.RFC3339, tc.time)
+			if _, ok := cron.earliest(now, time.Second); ok != tc.matches {
+				t.Errorf("Expected match: %v, got %v", tc.matches, ok)
+			}
+		})
+	}
+
+	for _, invalid := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	s, err := loadSchedule("testdata/schedule.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		time     string
+		expected Time
+	}{
+		{
+			time: "2024-06-07T15:59:00Z",
+			expected: Time{Active: []string{}, Windows: map[string]WindowState{
+				"maintenance": {}, "weekend-freeze": {}, "year-end": {},
+			}},
+		},
+		{
+			// Friday 18:00 in Berlin.
+			time: "2024-06-07T16:00:00Z",
+			expected: Time{Active: []string{"weekend-freeze"}, Windows: map[string]WindowState{
+				"maintenance":    {},
+				"weekend-freeze": {Active: true, Start: "2024-06-07T18:00:00+02:00", End: "2024-06-10T08:00:00+02:00"},
+				"year-end":       {},
+			}},
+		},
+		{
+			time: "2024-06-09T03:30:00Z",
+			expected: Time{Active: []string{"maintenance", "weekend-freeze"}, Windows: map[string]WindowState{
+				"maintenance":    {Active: true, Start: "2024-06-09T02:00:00Z", End: "2024-06-09T04:00:00Z"},
+				"weekend-freeze": {Active: true, Start: "2024-06-07T18:00:00+02:00", End: "2024-06-10T08:00:00+02:00"},
+				"year-end":       {},
+			}},
+		},
+		{
+			time: "2024-06-10T06:00:00Z",
+			expected: Time{Active: []string{}, Windows: map[string]WindowState{
+				"maintenance": {}, "weekend-freeze": {}, "year-end": {},
+			}},
+		},
+		{
+			time: "2025-01-06T07:59:00Z",
+			expected: Time{Active: []string{"year-end"}, Windows: map[string]WindowState{
+				"maintenance":    {},
+				"weekend-freeze": {},
+				"year-end":       {Active: true, Start: "2024-12-20T00:00:00+01:00", End: "2025-01-06T09:00:00+01:00"},
+			}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.time, func(t *testing.T) {
+			now, _ := time.Parse(time.RFC3339, tc.time)
+			if got := s.at(now); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoadScheduleErrors(t *testing.T) {
+	for _, doc := range []string{
+		"windows: {freeze: {cron: '0 18 * * 5'}}",
+		"windows: {freeze: {cron: '0 18 * * 5', duration: -1h}}",
+		"windows: {freeze: {start: 2024-12-20}}",
+		"windows: {freeze: {start: 2024-12-20, end: 2024-12-19}}",
+		"windows: {freeze: {cron: '0 18 * * 5', duration: 1h, start: 2024-12-20, end: 2024-12-21}}",
+		"windows: {freeze: {cron: '0 18 * * 5', duration: 1h, timezone: Nowhere/City}}",
+	} {
+		file := filepath.Join(t.TempDir(), "schedule.yaml")
+		if err := os.WriteFile(file, []byte(doc), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadSchedule(file); err == nil {
+			t.Errorf("Expected error for %s", doc)
+		}
+	}
+}
+
+func TestAuthZReqSchedule(t *testing.T) {
+	always, err := newWindow("weekend-freeze", windowSpec{Cron: "* * * * *", Duration: "1h"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/freeze.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		schedule:   &schedule{windows: []window{always}},
+	}
+
+	res := plugin.AuthZReq(authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/services/web/update"})
+	if res.Allow || res.Msg == "" || res.Msg == defaultDenyMessage {
+		t.Errorf("Expected service update to be denied during the freeze, got %+v", res)
+	}
+	if res := plugin.AuthZReq(authorization.Request{RequestMethod: "GET", RequestURI: "/v1.47/services"}); !res.Allow {
+		t.Errorf("Expected service listing to be allowed, got %+v", res)
+	}
+}
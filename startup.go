@@ -0,0 +1,89 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// Startup modes of config-file mode. In background mode the plugin serves
+// requests while its bundles are downloaded, deciding them with the fallback
+// policy until the bundles are activated.
+const (
+	startupBlock      = "block"
+	startupBackground = "background"
+)
+
+var errBundlesNotActivated = errors.New("policy bundles are not activated yet")
+
+// bundleStartup tracks the activation of the bundles of config-file mode when
+// starting in background mode. A nil *bundleStartup is always activated.
+type bundleStartup struct {
+	// ready is closed by the OPA SDK once all bundles are activated.
+	ready chan struct{}
+
+	// policyFile is the fallback policy. Without a fallback policy file,
+	// requests are decided by the embedded fallback policy, or handled
+	// according to the failure mode if there is none.
+	policyFile string
+}
+
+func newBundleStartup(policyFile string) *bundleStartup {
+	return &bundleStartup{
+		ready:      make(chan struct{}),
+		policyFile: policyFile,
+	}
+}
+
+// activated reports whether the bundles have been activated.
+func (s *bundleStartup) activated() bool {
+
+	if s == nil {
+		return true
+	}
+
+	select {
+	case <-s.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait logs the switch from the fallback policy to the bundles once they are
+// activated, or ctx is done.
+func (s *bundleStartup) wait(ctx context.Context) {
+
+	if s.policyFile != "" {
+		log.Printf("Deciding requests with fallback policy %s until bundles are activated.", s.policyFile)
+	} else if fb, _ := embeddedFallback(); fb != nil {
+		log.Printf("Deciding requests with the embedded fallback policy %s until bundles are activated.", fb.revision)
+	} else {
+		log.Printf("Failing requests until bundles are activated.")
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-s.ready:
+		log.Printf("Bundles activated, deciding requests with the configured policy.")
+	}
+}
+
+// fallback returns the policy deciding requests received before the bundles
+// were activated: the fallback policy file if one is configured, and
+// otherwise the embedded fallback policy if there is one.
+func (s *bundleStartup) fallback(ctx context.Context, c compileOptions) (policyVersion, error) {
+
+	if s.policyFile != "" {
+		return regoFile{path: s.policyFile, compile: c}.Policy(ctx)
+	}
+	if fb, _ := embeddedFallback(); fb != nil {
+		return fb.policy(c), nil
+	}
+
+	return policyVersion{}, errBundlesNotActivated
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/storage/inmem"
+)
+
+func TestAuthZReqBackgroundStartup(t *testing.T) {
+	ctx := context.Background()
+
+	ready := make(chan struct{})
+	config := writeBundleConfig(t, t.TempDir(), "bundle", "r1", "package docker.authz\n\nallow := true\n")
+	opa, err := initOPA(ctx, config, nil, inmem.New(), ready)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer opa.Stop(ctx)
+
+	select {
+	case <-ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected bundles to be activated in the background")
+	}
+
+	request := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create"}
+
+	tests := []struct {
+		note          string
+		fallback      string
+		failureMode   string
+		activated     bool
+		expectedAllow bool
+		expectedErr   bool
+	}{
+		{note: "fallback policy", fallback: "testdata/default_allow.rego", failureMode: failClosed, expectedAllow: false},
+		{note: "failure mode closed", failureMode: failClosed, expectedAllow: false, expectedErr: true},
+		{note: "failure mode open", failureMode: failOpen, expectedAllow: true},
+		{note: "activated", fallback: "testdata/default_allow.rego", failureMode: failClosed, activated: true, expectedAllow: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.note, func(t *testing.T) {
+			plugin := DockerAuthZPlugin{
+				configFile:  "config.yaml",
+				allowPath:   "data.docker.authz.allow",
+				quiet:       true,
+				mode:        modeEnforce,
+				failureMode: tc.failureMode,
+				opa:         opa,
+				startup:     newBundleStartup(tc.fallback),
+			}
+			if tc.activated {
+				close(plugin.startup.ready)
+			}
+
+			response := plugin.AuthZReq(request)
+			if response.Allow != tc.expectedAllow {
+				t.Errorf("Expected allow: %v, got: %v", tc.expectedAllow, response.Allow)
+			}
+			if (response.Err != "") != tc.expectedErr {
+				t.Errorf("Expected error: %v, got: %q", tc.expectedErr, response.Err)
+			}
+		})
+	}
+}
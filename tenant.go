@@ -0,0 +1,148 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/util"
+)
+
+// Tenant is the team a principal belongs to, exposed to policy as
+// input.Tenant along with whether the object created or renamed by the
+// request satisfies the naming and labelling rules of the team.
+type Tenant struct {
+	Name     string
+	Prefixes []string
+	Labels   map[string]string
+
+	// ObjectName is the name given to the object by the request, if any.
+	ObjectName string
+
+	// NameAllowed is true if ObjectName starts with one of Prefixes.
+	NameAllowed bool
+
+	// MissingLabels are the keys of the required Labels the request does not
+	// set to the required value.
+	MissingLabels []string
+}
+
+// tenantSpec is the definition of a tenant in the tenants file.
+type tenantSpec struct {
+	Members  []string          `json:"members"`
+	Groups   []string          `json:"groups"`
+	Prefixes []string          `json:"prefixes"`
+	Labels   map[string]string `json:"labels"`
+}
+
+// includes reports whether the principal or one of its groups is a member of
+// the tenant. Principals that were not verified, like those asserted by the
+// client through the header source, are members of no tenant.
+func (s tenantSpec) includes(identity Identity) bool {
+
+	if identity.Name == "" || !identity.Verified {
+		return false
+	}
+	if slices.Contains(s.Members, identity.Name) {
+		return true
+	}
+
+	return slices.ContainsFunc(identity.Groups, func(group string) bool {
+		return slices.Contains(s.Groups, group)
+	})
+}
+
+// tenancy maps principals to their tenants. A nil *tenancy resolves no
+// tenants.
+type tenancy struct {
+	names   []string
+	tenants map[string]tenantSpec
+}
+
+// loadTenancy loads the tenants defined in a YAML or JSON file, e.g.
+// {"tenants": {"payments": {"groups": ["payments"], "prefixes": ["payments-"]}}}.
+func loadTenancy(file string) (*tenancy, error) {
+
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Tenants map[string]tenantSpec `json:"tenants"`
+	}
+	if err := util.Unmarshal(bs, &doc); err != nil {
+		return nil, fmt.Errorf("invalid tenants file %s: %w", file, err)
+	}
+
+	t := &tenancy{tenants: doc.Tenants}
+	for name, spec := range doc.Tenants {
+		if len(spec.Prefixes) == 0 {
+			return nil, fmt.Errorf("tenant %s in %s has no name prefixes", name, file)
+		}
+		t.names = append(t.names, name)
+	}
+	sort.Strings(t.names)
+
+	return t, nil
+}
+
+// resolve returns the tenant of the principal making the request, i.e. the
+// first tenant in name order listing the principal or one of its groups. The
+// returned Tenant has an empty Name if the principal belongs to no tenant.
+func (t *tenancy) resolve(identity Identity, r authorization.Request, body map[string]interface{}) Tenant {
+
+	tenant := Tenant{Prefixes: []string{}, Labels: map[string]string{}, MissingLabels: []string{}}
+
+	for _, name := range t.names {
+		spec := t.tenants[name]
+		if spec.includes(identity) {
+			tenant.Name = name
+			tenant.Prefixes = append(tenant.Prefixes, spec.Prefixes...)
+			for k, v := range spec.Labels {
+				tenant.Labels[k] = v
+			}
+			break
+		}
+	}
+
+	tenant.ObjectName = objectName(r, body)
+	for _, prefix := range tenant.Prefixes {
+		if tenant.ObjectName != "" && strings.HasPrefix(tenant.ObjectName, prefix) {
+			tenant.NameAllowed = true
+		}
+	}
+
+	labels, _ := body["Labels"].(map[string]interface{})
+	for k, v := range tenant.Labels {
+		if labels[k] != v {
+			tenant.MissingLabels = append(tenant.MissingLabels, k)
+		}
+	}
+	sort.Strings(tenant.MissingLabels)
+
+	return tenant
+}
+
+// objectName returns the name a request gives to the object it creates or
+// renames: the name query parameter of container creates and renames, or
+// the Name in the body of other creates.
+func objectName(r authorization.Request, body map[string]interface{}) string {
+
+	if u, err := url.Parse(r.RequestURI); err == nil {
+		if name := u.Query().Get("name"); name != "" {
+			return strings.TrimPrefix(name, "/")
+		}
+	}
+
+	name, _ := body["Name"].(string)
+	return name
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestTenancyResolve(t *testing.T) {
+	tenants, err := loadTenancy("testdata/tenants.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		identity Identity
+		uri      string
+		body     map[string]interface{}
+		expected Tenant
+	}{
+		{
+			name:     "group member creating a named and labelled container",
+			identity: Identity{Name: "alice", Verified: true, Groups: []string{"developers", "payments"}},
+			uri:      "/v1.47/containers/create?name=payments-api",
+			body:     map[string]interface{}{"Labels": map[string]interface{}{"team": "payments"}},
+			expected: Tenant{
+				Name:          "payments",
+				Prefixes:      []string{"payments-", "pay-"},
+				Labels:        map[string]string{"team": "payments"},
+				ObjectName:    "payments-api",
+				NameAllowed:   true,
+				MissingLabels: []string{},
+			},
+		},
+		{
+			name:     "group member creating an unlabelled container of another tenant",
+			identity: Identity{Name: "alice", Verified: true, Groups: []string{"payments"}},
+			uri:      "/v1.47/containers/create?name=search-api",
+			expected: Tenant{
+				Name:          "payments",
+				Prefixes:      []string{"payments-", "pay-"},
+				Labels:        map[string]string{"team": "payments"},
+				ObjectName:    "search-api",
+				MissingLabels: []string{"team"},
+			},
+		},
+		{
+			name:     "member renaming a container",
+			identity: Identity{Name: "carol", Verified: true},
+			uri:      "/v1.47/containers/abc/rename?name=search-worker",
+			expected: Tenant{
+				Name:          "search",
+				Prefixes:      []string{"search-"},
+				Labels:        map[string]string{},
+				ObjectName:    "search-worker",
+				NameAllowed:   true,
+				MissingLabels: []string{},
+			},
+		},
+		{
+			name:     "member creating a named volume",
+			identity: Identity{Name: "carol", Verified: true},
+			uri:      "/v1.47/volumes/create",
+			body:     map[string]interface{}{"Name": "data"},
+			expected: Tenant{
+				Name:          "search",
+				Prefixes:      []string{"search-"},
+				Labels:        map[string]string{},
+				ObjectName:    "data",
+				MissingLabels: []string{},
+			},
+		},
+		{
+			name:     "unverified member",
+			identity: Identity{Name: "carol", Groups: []string{"payments"}},
+			uri:      "/v1.47/containers/create?name=search-api",
+			expected: Tenant{
+				Prefixes:      []string{},
+				Labels:        map[string]string{},
+				ObjectName:    "search-api",
+				MissingLabels: []string{},
+			},
+		},
+		{
+			name:     "principal without tenant",
+			identity: Identity{Name: "dave", Verified: true, Groups: []string{"developers"}},
+			uri:      "/v1.47/containers/create?name=payments-api",
+			expected: Tenant{
+				Prefixes:      []string{},
+				Labels:        map[string]string{},
+				ObjectName:    "payments-api",
+				MissingLabels: []string{},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := authorization.Request{RequestMethod: "POST", RequestURI: tc.uri}
+			if got := tenants.resolve(tc.identity, r, tc.body); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestLoadTenancyErrors(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tenants.yaml")
+	if err := os.WriteFile(file, []byte("tenants:\n  payments:\n    groups: [payments]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTenancy(file); err == nil {
+		t.Errorf("Expected error for tenant without prefixes")
+	}
+	if _, err := loadTenancy("testdata/nonexistent.yaml"); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func TestEvaluateTenancy(t *testing.T) {
+	tenants, err := loadTenancy("testdata/tenants.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/tenancy.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		tenants:    tenants,
+	}
+
+	tests := []struct {
+		user    string
+		uri     string
+		body    string
+		allowed bool
+	}{
+		{"carol", "/v1.47/containers/create?name=search-api", `{"Image": "busybox"}`, true},
+		{"carol", "/v1.47/containers/create?name=payments-api", `{"Image": "busybox"}`, false},
+		{"carol", "/v1.47/containers/create", `{"Image": "busybox"}`, false},
+		{"dave", "/v1.47/containers/create?name=search-api", `{"Image": "busybox"}`, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.user+" "+tc.uri, func(t *testing.T) {
+			r := authorization.Request{
+				RequestMethod:   "POST",
+				RequestURI:      tc.uri,
+				RequestHeaders:  map[string]string{"Content-Type": "application/json"},
+				RequestBody:     []byte(tc.body),
+				User:            tc.user,
+				UserAuthNMethod: "TLS",
+			}
+			allowed, err := plugin.evaluate(context.Background(), r)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if allowed != tc.allowed {
+				t.Errorf("Expected allowed: %v, got %v", tc.allowed, allowed)
+			}
+		})
+	}
+}
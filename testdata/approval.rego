@@ -0,0 +1,11 @@
+package docker.authz
+
+default allow := {"allow": true}
+
+allow := {
+	"allow": false,
+	"reason": "privileged containers require approval",
+	"requires_approval": true,
+} if {
+	input.Body.HostConfig.Privileged
+}
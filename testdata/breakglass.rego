@@ -0,0 +1,11 @@
+package docker.authz
+
+default allow := {"allow": false}
+
+allow := {"allow": true} if input.Method == "GET"
+
+# Plugins may never be installed with a break-glass token.
+allow := {"allow": false, "break_glass": false} if {
+	input.Method != "GET"
+	contains(input.PathPlain, "/plugins/")
+}
@@ -0,0 +1,12 @@
+package docker.authz
+
+default allow := {"allow": true}
+
+allow := {
+	"allow": false,
+	"reason": sprintf("services are frozen until %s", [input.Time.Windows["weekend-freeze"].End]),
+} if {
+	input.Method == "POST"
+	endswith(input.PathPlain, "/update")
+	"weekend-freeze" in input.Time.Active
+}
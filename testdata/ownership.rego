@@ -0,0 +1,19 @@
+package docker.authz
+
+default allow := false
+
+# Anyone may create and list objects.
+allow if {
+	not input.Target
+}
+
+# Anyone may act on objects that predate tracking or have no owner.
+allow if {
+	input.Target.Owner == ""
+}
+
+# Otherwise only their verified creator may act on objects.
+allow if {
+	input.Target.Owner == input.Identity.Name
+	input.Identity.Verified
+}
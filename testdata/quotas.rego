@@ -0,0 +1,10 @@
+package docker.authz
+
+default allow := {"allow": true}
+
+allow := {
+	"allow": false,
+	"reason": sprintf("quota exhausted: %s", [concat(", ", input.Usage.Exhausted)]),
+} if {
+	count(input.Usage.Exhausted) > 0
+}
@@ -0,0 +1,10 @@
+package docker.authz
+
+default allow := false
+
+# allow takes far longer to evaluate than any reasonable decision timeout.
+allow if {
+	some i in numbers.range(1, 100000)
+	some j in numbers.range(1, 100000)
+	i * j < 0
+}
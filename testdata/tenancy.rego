@@ -0,0 +1,14 @@
+package docker.authz
+
+default allow := false
+
+allow if input.Method == "GET"
+
+# Members of a tenant may only create containers named and labelled for it.
+allow if {
+	input.PathArr[2] == "containers"
+	input.PathArr[3] == "create"
+	input.Tenant.Name != ""
+	input.Tenant.NameAllowed
+	count(input.Tenant.MissingLabels) == 0
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 The OPA Authors.  All rights reserved.
+// Use of this source code is governed by an Apache2
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+	"github.com/open-policy-agent/opa/v1/util"
+	"golang.org/x/time/rate"
+)
+
+// Names of the quotas, as used in the quotas file and in Usage.Exhausted.
+const (
+	quotaRequestsPerSecond = "requests_per_second"
+	quotaContainersPerHour = "containers_per_hour"
+	quotaConcurrentExecs   = "concurrent_execs"
+)
+
+// Usage is the recent activity of the principal making a request, exposed to
+// policy as input.Usage.
+type Usage struct {
+	ContainersCreatedLastHour int
+	ConcurrentExecs           int
+	Limits                    QuotaLimits
+
+	// Exhausted lists the quotas the principal has no capacity left in. The
+	// request rate quota is exhausted if the request itself exceeds it.
+	Exhausted []string
+}
+
+// QuotaLimits are the quotas of a principal. Zero disables a quota.
+type QuotaLimits struct {
+	RequestsPerSecond float64
+	Burst             int
+	ContainersPerHour int
+	ConcurrentExecs   int
+}
+
+// quotaSpec sets some of the quotas in the quotas file.
+type quotaSpec struct {
+	RequestsPerSecond *float64 `json:"requests_per_second"`
+	Burst             *int     `json:"burst"`
+	ContainersPerHour *int     `json:"containers_per_hour"`
+	ConcurrentExecs   *int     `json:"concurrent_execs"`
+}
+
+func (s quotaSpec) apply(l QuotaLimits) QuotaLimits {
+	if s.RequestsPerSecond != nil {
+		l.RequestsPerSecond = *s.RequestsPerSecond
+	}
+	if s.Burst != nil {
+		l.Burst = *s.Burst
+	}
+	if s.ContainersPerHour != nil {
+		l.ContainersPerHour = *s.ContainersPerHour
+	}
+	if s.ConcurrentExecs != nil {
+		l.ConcurrentExecs = *s.ConcurrentExecs
+	}
+	return l
+}
+
+type usageContextKey struct{}
+
+// withUsage returns a context carrying the usage of the principal making the
+// request, added to the input document of the request.
+func withUsage(ctx context.Context, usage Usage) context.Context {
+	return context.WithValue(ctx, usageContextKey{}, usage)
+}
+
+// usageTracker counts the requests, container creations and running execs of
+// each principal. A nil *usageTracker tracks nothing.
+type usageTracker struct {
+	mtx      sync.Mutex
+	defaults QuotaLimits
+	users    map[string]QuotaLimits
+	limiters map[string]*rate.Limiter
+	created  map[string][]time.Time
+	execs    map[string]string
+	now      func() time.Time
+}
+
+// loadUsageTracker loads the quotas defined in a YAML or JSON file, e.g.
+// {"defaults": {"containers_per_hour": 50}, "users": {"ci": {"containers_per_hour": 500}}}.
+func loadUsageTracker(file string) (*usageTracker, error) {
+
+	bs, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Defaults quotaSpec            `json:"defaults"`
+		Users    map[string]quotaSpec `json:"users"`
+	}
+	if err := util.Unmarshal(bs, &doc); err != nil {
+		return nil, fmt.Errorf("invalid quotas file %s: %w", file, err)
+	}
+
+	t := newUsageTracker(doc.Defaults.apply(QuotaLimits{}))
+	for name, spec := range doc.Users {
+		t.users[name] = spec.apply(t.defaults)
+	}
+
+	return t, nil
+}
+
+func newUsageTracker(defaults QuotaLimits) *usageTracker {
+	return &usageTracker{
+		defaults: defaults,
+		users:    map[string]QuotaLimits{},
+		limiters: map[string]*rate.Limiter{},
+		created:  map[string][]time.Time{},
+		execs:    map[string]string{},
+		now:      time.Now,
+	}
+}
+
+func (t *usageTracker) limits(principal string) QuotaLimits {
+	if l, ok := t.users[principal]; ok {
+		return l
+	}
+	return t.defaults
+}
+
+// take counts a request of the principal against its request rate, and
+// returns the usage of the principal.
+func (t *usageTracker) take(principal string) Usage {
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	limits := t.limits(principal)
+	usage := Usage{Limits: limits, Exhausted: []string{}}
+
+	if limits.RequestsPerSecond > 0 {
+		limiter, ok := t.limiters[principal]
+		if !ok {
+			burst := max(limits.Burst, int(math.Ceil(limits.RequestsPerSecond)))
+			limiter = rate.NewLimiter(rate.Limit(limits.RequestsPerSecond), burst)
+			t.limiters[principal] = limiter
+		}
+		if !limiter.AllowN(now, 1) {
+			usage.Exhausted = append(usage.Exhausted, quotaRequestsPerSecond)
+		}
+	}
+
+	usage.ContainersCreatedLastHour = len(t.recentCreations(principal, now))
+	if limits.ContainersPerHour > 0 && usage.ContainersCreatedLastHour >= limits.ContainersPerHour {
+		usage.Exhausted = append(usage.Exhausted, quotaContainersPerHour)
+	}
+
+	for _, owner := range t.execs {
+		if owner == principal {
+			usage.ConcurrentExecs++
+		}
+	}
+	if limits.ConcurrentExecs > 0 && usage.ConcurrentExecs >= limits.ConcurrentExecs {
+		usage.Exhausted = append(usage.Exhausted, quotaConcurrentExecs)
+	}
+
+	return usage
+}
+
+// recentCreations drops the container creations of the principal older than
+// an hour, returning the remaining ones. The caller must hold the lock.
+func (t *usageTracker) recentCreations(principal string, now time.Time) []time.Time {
+
+	created := t.created[principal]
+	i := 0
+	for i < len(created) && now.Sub(created[i]) >= time.Hour {
+		i++
+	}
+	created = created[i:]
+
+	if len(created) == 0 {
+		delete(t.created, principal)
+	} else {
+		t.created[principal] = created
+	}
+
+	return created
+}
+
+// usagePrincipal returns the principal whose usage a request counts against.
+// Names that were not verified, like those asserted by the client through
+// the header source, could be chosen to exhaust the quotas of another
+// principal or to escape one's own, so all unverified requests share the
+// quotas of the anonymous principal.
+func usagePrincipal(identity Identity) string {
+
+	if !identity.Verified {
+		return ""
+	}
+
+	return identity.Name
+}
+
+// acquire records an allowed request of the principal starting an exec,
+// which runs until the response to the request is returned.
+func (t *usageTracker) acquire(principal string, r authorization.Request) {
+
+	if t == nil {
+		return
+	}
+
+	if id, ok := execStart(r); ok {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		t.execs[id] = principal
+	}
+}
+
+// release records the end of the exec started by the request, if any.
+func (t *usageTracker) release(r authorization.Request) {
+
+	if t == nil {
+		return
+	}
+
+	if id, ok := execStart(r); ok {
+		t.mtx.Lock()
+		defer t.mtx.Unlock()
+		delete(t.execs, id)
+	}
+}
+
+// observe records the containers created by the principal returned by
+// principal, and the end of execs, after an API response.
+func (t *usageTracker) observe(r authorization.Request, principal func() string) {
+
+	if t == nil {
+		return
+	}
+
+	t.release(r)
+
+	route := parseRoute(r.RequestURI)
+	if route.Type != objectContainer || route.Ref != "" || route.Action != "create" || r.RequestMethod != http.MethodPost {
+		return
+	}
+	if r.ResponseStatusCode < 200 || r.ResponseStatusCode > 299 {
+		return
+	}
+
+	name := principal()
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	t.created[name] = append(t.recentCreations(name, now), now)
+}
+
+// execStart returns the ID of the exec started by a request, if any.
+func execStart(r authorization.Request) (string, bool) {
+
+	if r.RequestMethod != http.MethodPost {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(apiPath(r.RequestURI), "/"), "/")
+	if len(parts) != 3 || parts[0] != "exec" || parts[2] != "start" {
+		return "", false
+	}
+
+	return parts[1], true
+}
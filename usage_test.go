@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/authorization"
+)
+
+func TestUsageTracker(t *testing.T) {
+	tracker, err := loadUsageTracker("testdata/quotas.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	expectedLimits := QuotaLimits{RequestsPerSecond: 1, Burst: 2, ContainersPerHour: 2, ConcurrentExecs: 1}
+	if limits := tracker.limits("alice"); limits != expectedLimits {
+		t.Errorf("Expected default limits %+v, got %+v", expectedLimits, limits)
+	}
+	expectedLimits = QuotaLimits{Burst: 2, ContainersPerHour: 100, ConcurrentExecs: 1}
+	if limits := tracker.limits("ci"); limits != expectedLimits {
+		t.Errorf("Expected ci limits %+v, got %+v", expectedLimits, limits)
+	}
+
+	t.Run("request rate", func(t *testing.T) {
+		for i, expected := range [][]string{{}, {}, {quotaRequestsPerSecond}} {
+			if usage := tracker.take("alice"); !reflect.DeepEqual(usage.Exhausted, expected) {
+				t.Errorf("Expected request %d to exhaust %v, got %v", i, expected, usage.Exhausted)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if usage := tracker.take("ci"); len(usage.Exhausted) != 0 {
+				t.Fatalf("Expected ci not to be rate limited, got %v", usage.Exhausted)
+			}
+		}
+		now = now.Add(time.Second)
+	})
+
+	t.Run("containers per hour", func(t *testing.T) {
+		create := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create", ResponseStatusCode: 201}
+		failed := create
+		failed.ResponseStatusCode = 409
+
+		tracker.observe(create, func() string { return "bob" })
+		tracker.observe(failed, func() string { return "bob" })
+		now = now.Add(30 * time.Minute)
+		tracker.observe(create, func() string { return "bob" })
+
+		if usage := tracker.take("bob"); usage.ContainersCreatedLastHour != 2 || !reflect.DeepEqual(usage.Exhausted, []string{quotaContainersPerHour}) {
+			t.Errorf("Expected containers quota to be exhausted, got %+v", usage)
+		}
+
+		now = now.Add(31 * time.Minute)
+		if usage := tracker.take("bob"); usage.ContainersCreatedLastHour != 1 || len(usage.Exhausted) != 0 {
+			t.Errorf("Expected one container created in the last hour, got %+v", usage)
+		}
+	})
+
+	t.Run("concurrent execs", func(t *testing.T) {
+		start := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/exec/e1/start"}
+		tracker.acquire("carol", start)
+
+		if usage := tracker.take("carol"); usage.ConcurrentExecs != 1 || !reflect.DeepEqual(usage.Exhausted, []string{quotaConcurrentExecs}) {
+			t.Errorf("Expected execs quota to be exhausted, got %+v", usage)
+		}
+
+		start.ResponseStatusCode = 200
+		tracker.observe(start, func() string { return "carol" })
+		if usage := tracker.take("carol"); usage.ConcurrentExecs != 0 {
+			t.Errorf("Expected exec to have ended, got %+v", usage)
+		}
+	})
+}
+
+func TestAuthZReqQuotas(t *testing.T) {
+	tracker := newUsageTracker(QuotaLimits{ContainersPerHour: 1})
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/quotas.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		usage:      tracker,
+	}
+
+	create := authorization.Request{RequestMethod: "POST", RequestURI: "/v1.47/containers/create", User: "alice", UserAuthNMethod: "TLS"}
+	if res := plugin.AuthZReq(create); !res.Allow {
+		t.Fatalf("Expected first container to be allowed, got %+v", res)
+	}
+
+	create.ResponseStatusCode = 201
+	create.ResponseBody = []byte(`{"Id": "4fa6e0f0c678"}`)
+	plugin.AuthZRes(create)
+
+	res := plugin.AuthZReq(create)
+	if res.Allow || !strings.HasPrefix(res.Msg, "quota exhausted: containers_per_hour [policy sha256:") {
+		t.Errorf("Expected second container to be denied with reason, got %+v", res)
+	}
+}
+
+func TestAuthZReqQuotasUnverified(t *testing.T) {
+	tracker := newUsageTracker(QuotaLimits{ContainersPerHour: 1})
+	plugin := DockerAuthZPlugin{
+		policyFile: "testdata/quotas.rego",
+		allowPath:  "data.docker.authz.allow",
+		quiet:      true,
+		usage:      tracker,
+	}
+
+	create := func(r authorization.Request) authorization.Request {
+		r.RequestMethod = "POST"
+		r.RequestURI = "/v1.47/containers/create"
+		return r
+	}
+	asserted := func(name string) authorization.Request {
+		return create(authorization.Request{RequestHeaders: map[string]string{"Authz-User": name}})
+	}
+
+	first := asserted("mallory")
+	if res := plugin.AuthZReq(first); !res.Allow {
+		t.Fatalf("Expected first container to be allowed, got %+v", res)
+	}
+	first.ResponseStatusCode = 201
+	first.ResponseBody = []byte(`{"Id": "4fa6e0f0c678"}`)
+	plugin.AuthZRes(first)
+
+	// Rotating the asserted name does not escape the quota, and asserting the
+	// name of a verified principal does not exhaust its quota.
+	if res := plugin.AuthZReq(asserted("mallory-2")); res.Allow {
+		t.Errorf("Expected unverified principals to share a quota, got %+v", res)
+	}
+	if res := plugin.AuthZReq(asserted("alice")); res.Allow {
+		t.Errorf("Expected unverified principals to share a quota, got %+v", res)
+	}
+	if res := plugin.AuthZReq(create(authorization.Request{User: "alice", UserAuthNMethod: "TLS"})); !res.Allow {
+		t.Errorf("Expected verified alice to have a separate quota, got %+v", res)
+	}
+}